@@ -0,0 +1,39 @@
+package main
+
+import "os"
+
+// serverVersion is what version.bind / version.server report.
+const serverVersion = "codecrafters-dns-server-go"
+
+// isSupportedClass reports whether queries in a class can be answered at all.
+func isSupportedClass(class QClass) bool {
+	return class == classIN || class == classCH || class == classANY
+}
+
+// chaosAnswer answers the conventional CH-class TXT built-ins that report the server
+// version and identity. The boolean is false for CH names we don't serve.
+func chaosAnswer(question DNSQuestion) ([]ResourceRecord, bool) {
+	var text string
+	switch canonicalName(question.Name) {
+	case "version.bind", "version.server":
+		text = serverVersion
+	case "hostname.bind", "id.server":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, false
+		}
+		text = hostname
+	default:
+		return nil, false
+	}
+
+	if question.Type != typeTXT && question.Type != typeANY { // anything else is NODATA
+		return []ResourceRecord{}, true
+	}
+
+	if len(text) > 255 {
+		text = text[:255] // a single character-string, as dig +short expects
+	}
+
+	return []ResourceRecord{{Name: question.Name, Type: typeTXT, Class: classCH, TTL: 0, Data: TXTData{Strings: []string{text}}}}, true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// maxPointerOffset is the first offset a 14-bit compression pointer can't reach.
+const maxPointerOffset = 0x4000
+
+// compressor tracks the names already written to a message so later names can end in
+// a pointer to them instead of repeating their labels (RFC 1035 section 4.1.4). One
+// compressor is shared by everything written to the same message.
+type compressor struct {
+	offsets map[string]int // lowercased name, without trailing dot, to where it starts
+}
+
+func newCompressor() *compressor {
+	return &compressor{offsets: map[string]int{}}
+}
+
+// appendName appends name to msg, ending it with a pointer to the longest suffix that
+// was already written. Names compare case-insensitively, as DNS does. A nil compressor
+// writes the name in full, for RDATA that must not be compressed (RFC 3597 section 4).
+func (c *compressor) appendName(msg []byte, name string) ([]byte, error) {
+	encoded, err := encodeName(name)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSuffix(name, ".")
+	if c == nil || name == "" {
+		return append(msg, encoded...), nil
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		suffix := foldCase(strings.Join(labels[i:], "."))
+		if offset, ok := c.offsets[suffix]; ok {
+			return binary.BigEndian.AppendUint16(msg, 0xC000|uint16(offset)), nil
+		}
+		if len(msg) < maxPointerOffset {
+			c.offsets[suffix] = len(msg)
+		}
+
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+
+	return append(msg, 0x00), nil
+}
+
+// remember registers the name that starts at offset in msg, such as a question copied
+// as is from the query, so names written later can point into it.
+func (c *compressor) remember(msg []byte, offset int) {
+	for offset < len(msg) && offset < maxPointerOffset {
+		length := int(msg[offset])
+		if length == 0 || length&0xC0 != 0 { // end of the name, or a pointer to a name seen before
+			return
+		}
+
+		suffix, _, err := parseDomainName(msg, offset)
+		if err != nil {
+			return
+		}
+		suffix = canonicalName(suffix)
+		if _, seen := c.offsets[suffix]; !seen {
+			c.offsets[suffix] = offset
+		}
+
+		offset += 1 + length
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func BenchmarkAppendName(b *testing.B) {
+	// The names of a typical answer: the question, a CNAME target in the same zone and
+	// the NS and glue names of a referral
+	names := []string{"www.example.com", "www.example.com", "web.example.com", "ns1.example.com", "ns2.example.net", "ns1.example.com"}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := make([]byte, 12, 512)
+		c := newCompressor()
+		for _, name := range names {
+			var err error
+			if msg, err = c.appendName(msg, name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
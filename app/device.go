@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// ednsOptionMAC is the EDNS0 option code CPE such as dnsmasq (--add-mac) use to pass
+// the MAC address of the device that sent the query.
+const ednsOptionMAC = 65001
+
+// arpTable is the kernel's IPv4 neighbour table on Linux.
+const arpTable = "/proc/net/arp"
+
+// identifyDevice returns the MAC address of the device that sent a query, in the
+// canonical aa:bb:cc:dd:ee:ff form. A MAC forwarded in EDNS wins, but only from a client
+// in one of the sources networks, the CPE and forwarders that add it: any other client
+// could claim any device. Otherwise the client IP is looked up in the neighbour table,
+// which only works for clients on a directly attached network. It returns "" if the
+// device can't be identified.
+func identifyDevice(query []byte, client net.IP, sources []*net.IPNet) string {
+	if containsIP(sources, client) {
+		if mac := ednsDeviceMAC(query); mac != "" {
+			return mac
+		}
+	}
+
+	return neighbourMAC(client)
+}
+
+// parseNetworks parses a comma-separated list of networks in CIDR notation or single
+// addresses.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range splitList(list) {
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network or address %q", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP reports whether ip is in any of the networks.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ednsDeviceMAC extracts the device MAC address option from the query's OPT record.
+func ednsDeviceMAC(query []byte) string {
+	if len(query) < 12 {
+		return ""
+	}
+	_, offset, err := parseQuestions(query, 12, int(binary.BigEndian.Uint16(query[4:6])))
+	if err != nil {
+		return ""
+	}
+	start, end := findOPT(query, offset)
+	if start < 0 {
+		return ""
+	}
+
+	_, offset, _ = parseDomainName(query, start) // findOPT only returns complete records
+	for offset += 10; offset+4 <= end; {
+		code := binary.BigEndian.Uint16(query[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(query[offset+2 : offset+4]))
+		data := offset + 4
+		if data+length > end {
+			break
+		}
+
+		if code == ednsOptionMAC && length == 6 {
+			return net.HardwareAddr(query[data : data+length]).String()
+		}
+		offset = data + length
+	}
+
+	return ""
+}
+
+// neighbourMAC looks an IPv4 client up in the kernel's ARP table.
+func neighbourMAC(client net.IP) string {
+	if client == nil || client.To4() == nil {
+		return ""
+	}
+
+	file, err := os.Open(arpTable)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	// Columns: IP address, HW type, Flags, HW address, Mask, Device
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] == "0x0" { // header line or incomplete entry
+			continue
+		}
+
+		if ip := net.ParseIP(fields[0]); ip != nil && ip.Equal(client) {
+			return fields[3]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// macQuery builds a query with the device MAC option in its OPT record, after a cookie.
+func macQuery(t *testing.T, mac string) []byte {
+	t.Helper()
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := DNSMessage{
+		Header:    DNSHeader{ID: 1, RD: 1},
+		Questions: []DNSQuestion{{Name: "a.lan", Type: typeA, Class: classIN}},
+		Additionals: []ResourceRecord{EDNS{UDPSize: 1232, Options: []EDNSOption{
+			{Code: 10, Data: []byte("12345678")}, {Code: ednsOptionMAC, Data: hw},
+		}}.record()},
+	}
+	query, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return query
+}
+
+func TestIdentifyDeviceFromEDNS(t *testing.T) {
+	sources, err := parseNetworks("192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := macQuery(t, "02:00:00:00:00:01")
+
+	tests := []struct {
+		name    string
+		client  string
+		sources []*net.IPNet
+		trusted bool // or else the MAC must come from the neighbour table
+	}{
+		{name: "trusted address", client: "192.0.2.1", sources: sources, trusted: true},
+		{name: "trusted network", client: "2001:db8::53", sources: sources, trusted: true},
+		{name: "untrusted client on the same network", client: "192.0.2.2", sources: sources},
+		{name: "untrusted client elsewhere", client: "203.0.113.7", sources: sources},
+		{name: "no trusted sources", client: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := net.ParseIP(tt.client)
+			want := neighbourMAC(client)
+			if tt.trusted {
+				want = "02:00:00:00:00:01"
+			}
+			if got := identifyDevice(query, client, tt.sources); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestParseNetworksInvalid(t *testing.T) {
+	for _, list := range []string{"192.0.2.0/33", "cpe.lan", "192.0.2.1/24/8"} {
+		if networks, err := parseNetworks(list); err == nil {
+			t.Errorf("parseNetworks(%q) = %v, want an error", list, networks)
+		}
+	}
+}
+
+func TestEDNSOptionPolicyStripsMAC(t *testing.T) {
+	cookie := []byte("\x00\x0a\x00\x0812345678")
+	mac := []byte("\xfd\xe9\x00\x06\x02\x00\x00\x00\x00\x01")
+	rdata := append(append([]byte{}, cookie...), mac...)
+
+	tests := []struct {
+		name  string
+		rules string
+		want  []byte
+	}{
+		{name: "default", want: cookie},
+		{name: "passed", rules: "MAC=pass", want: rdata},
+		{name: "other options stripped", rules: "COOKIE=strip", want: []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := NewEDNSOptionPolicy()
+			if err := policy.addRules(tt.rules); err != nil {
+				t.Fatal(err)
+			}
+			if got := policy.apply(rdata); !bytes.Equal(got, tt.want) {
+				t.Errorf("got %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Opcode is the kind of request a message carries (RFC 1035 section 4.1.1, RFC 1996, RFC 2136).
+type Opcode uint16
+
+const (
+	opcodeQuery  Opcode = 0 // standard query
+	opcodeIQuery Opcode = 1 // inverse query, obsolete (RFC 3425)
+	opcodeStatus Opcode = 2 // server status request
+	opcodeNotify Opcode = 4 // zone change notification
+	opcodeUpdate Opcode = 5 // dynamic update
+)
+
+var opcodeNames = map[Opcode]string{
+	opcodeQuery:  "QUERY",
+	opcodeIQuery: "IQUERY",
+	opcodeStatus: "STATUS",
+	opcodeNotify: "NOTIFY",
+	opcodeUpdate: "UPDATE",
+}
+
+// String returns the opcode's mnemonic as dig prints it.
+func (o Opcode) String() string {
+	if name, ok := opcodeNames[o]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("OPCODE%d", uint16(o))
+}
+
+// RCode is the outcome of a request. The header only holds the low 4 bits; codes from
+// 16 up are extended RCODEs whose upper 8 bits travel in the OPT record's TTL (RFC 6891).
+type RCode uint16
+
+const (
+	rcodeNoError   RCode = 0  // no error
+	rcodeFormErr   RCode = 1  // the query couldn't be parsed
+	rcodeServFail  RCode = 2  // the server failed to process the query
+	rcodeNXDomain  RCode = 3  // the name does not exist
+	rcodeNotImp    RCode = 4  // the kind of query is not supported
+	rcodeRefused   RCode = 5  // the server won't answer for policy reasons
+	rcodeYXDomain  RCode = 6  // a name exists that should not (RFC 2136)
+	rcodeYXRRSet   RCode = 7  // an RRset exists that should not (RFC 2136)
+	rcodeNXRRSet   RCode = 8  // an RRset that should exist does not (RFC 2136)
+	rcodeNotAuth   RCode = 9  // the server is not authoritative for the zone (RFC 2136)
+	rcodeNotZone   RCode = 10 // a name is outside the zone (RFC 2136)
+	rcodeBadVers   RCode = 16 // unsupported EDNS version (RFC 6891)
+	rcodeBadKey    RCode = 17 // TSIG key not recognized (RFC 8945)
+	rcodeBadTime   RCode = 18 // TSIG signature out of its time window (RFC 8945)
+	rcodeBadMode   RCode = 19 // bad TKEY mode (RFC 2930)
+	rcodeBadName   RCode = 20 // duplicate TKEY key name (RFC 2930)
+	rcodeBadAlg    RCode = 21 // TKEY algorithm not supported (RFC 2930)
+	rcodeBadTrunc  RCode = 22 // bad TSIG truncation (RFC 8945)
+	rcodeBadCookie RCode = 23 // bad or missing server cookie (RFC 7873)
+)
+
+var rcodeNames = map[RCode]string{
+	rcodeNoError:   "NOERROR",
+	rcodeFormErr:   "FORMERR",
+	rcodeServFail:  "SERVFAIL",
+	rcodeNXDomain:  "NXDOMAIN",
+	rcodeNotImp:    "NOTIMP",
+	rcodeRefused:   "REFUSED",
+	rcodeYXDomain:  "YXDOMAIN",
+	rcodeYXRRSet:   "YXRRSET",
+	rcodeNXRRSet:   "NXRRSET",
+	rcodeNotAuth:   "NOTAUTH",
+	rcodeNotZone:   "NOTZONE",
+	rcodeBadVers:   "BADVERS",
+	rcodeBadKey:    "BADKEY",
+	rcodeBadTime:   "BADTIME",
+	rcodeBadMode:   "BADMODE",
+	rcodeBadName:   "BADNAME",
+	rcodeBadAlg:    "BADALG",
+	rcodeBadTrunc:  "BADTRUNC",
+	rcodeBadCookie: "BADCOOKIE",
+}
+
+// String returns the RCODE's mnemonic as dig prints it.
+func (r RCode) String() string {
+	if name, ok := rcodeNames[r]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("RCODE%d", uint16(r))
+}
+
+// headerFlags is the second 16-bit word of a message header: the flag bits, OPCODE and RCODE.
+type headerFlags uint16
+
+const (
+	flagQR headerFlags = 1 << 15 // message is a response
+	flagAA headerFlags = 1 << 10 // authoritative answer
+	flagTC headerFlags = 1 << 9  // truncated
+	flagRD headerFlags = 1 << 8  // recursion desired
+	flagRA headerFlags = 1 << 7  // recursion available
+	flagAD headerFlags = 1 << 5  // authentic data (RFC 4035)
+	flagCD headerFlags = 1 << 4  // checking disabled (RFC 4035)
+)
+
+var flagNames = []struct {
+	flag headerFlags
+	name string
+}{{flagQR, "qr"}, {flagAA, "aa"}, {flagTC, "tc"}, {flagRD, "rd"}, {flagRA, "ra"}, {flagAD, "ad"}, {flagCD, "cd"}}
+
+// messageFlags returns the flags word of a message, which must be at least 4 bytes long.
+func messageFlags(msg []byte) headerFlags {
+	return headerFlags(binary.BigEndian.Uint16(msg[2:4]))
+}
+
+// has reports whether a flag bit is set.
+func (f headerFlags) has(flag headerFlags) bool {
+	return f&flag != 0
+}
+
+// opcode returns the OPCODE field.
+func (f headerFlags) opcode() Opcode {
+	return Opcode(f>>11) & 0x0F
+}
+
+// rcode returns the 4-bit RCODE field of the header.
+func (f headerFlags) rcode() RCode {
+	return RCode(f) & 0x0F
+}
+
+// String returns the set flag bits in dig's lowercase form, e.g. "qr rd ra".
+func (f headerFlags) String() string {
+	set := []string{}
+	for _, flag := range flagNames {
+		if f.has(flag.flag) {
+			set = append(set, flag.name)
+		}
+	}
+
+	return strings.Join(set, " ")
+}
+
+// messageRCode returns the full RCODE of a message, including the upper 8 bits an OPT
+// record carries in its TTL. The message must be at least a header long.
+func messageRCode(msg []byte) RCode {
+	rcode := messageFlags(msg).rcode()
+
+	_, offset, err := parseQuestions(msg, 12, int(binary.BigEndian.Uint16(msg[4:6])))
+	if err != nil {
+		return rcode
+	}
+	if start, _ := findOPT(msg, offset); start >= 0 {
+		_, typeOffset, _ := parseDomainName(msg, start) // findOPT only returns complete records
+		rcode |= RCode(msg[typeOffset+4]) << 4
+	}
+
+	return rcode
+}
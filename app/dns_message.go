@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// DNSMessage is a complete DNS message: the header followed by the question, answer,
+// authority and additional sections (RFC 1035 section 4.1).
+type DNSMessage struct {
+	Header      DNSHeader
+	Questions   []DNSQuestion
+	Answers     []ResourceRecord
+	Authority   []ResourceRecord
+	Additionals []ResourceRecord
+}
+
+// ResourceRecord is a record of the answer, authority or additional section. Its RDATA
+// is decoded into the implementation for its type, so a record can be copied into
+// another message without carrying compression pointers along.
+type ResourceRecord struct {
+	Name     string
+	Type     QType
+	Class    QClass
+	TTL      uint32
+	RDLength uint16 // length of the RDATA as received; encoding recomputes it
+	Data     RDATA
+}
+
+// sectionNames names the record sections in the order they appear in a message.
+var sectionNames = []string{"answer", "authority", "additional"}
+
+// Unmarshal decodes a complete message, replacing the contents of m. Compression
+// pointers are resolved, also inside the RDATA of the types that may use them.
+// Bytes after the last record announced by the header are ignored. A misplaced or
+// repeated OPT record is an error.
+func (m *DNSMessage) Unmarshal(buf []byte) error {
+	if len(buf) < 12 {
+		return fmt.Errorf("message is %d bytes, shorter than a header", len(buf))
+	}
+
+	header := decodeHeader(buf)
+	questions, offset, err := parseQuestions(buf, 12, int(header.QDCOUNT))
+	if err != nil {
+		return err
+	}
+
+	sections := [3][]ResourceRecord{}
+	for i, count := range []uint16{header.ANCOUNT, header.NSCOUNT, header.ARCOUNT} {
+		for j := 0; j < int(count); j++ {
+			var record ResourceRecord
+			record, offset, err = parseRecord(buf, offset)
+			if err != nil {
+				return fmt.Errorf("%s record %d: %v", sectionNames[i], j+1, err)
+			}
+			sections[i] = append(sections[i], record)
+		}
+	}
+
+	decoded := DNSMessage{
+		Header:      header,
+		Questions:   questions,
+		Answers:     sections[0],
+		Authority:   sections[1],
+		Additionals: sections[2],
+	}
+	if err := decoded.checkOPT(); err != nil {
+		return err
+	}
+	*m = decoded
+
+	return nil
+}
+
+// Marshal encodes the message. The section counts in the header are taken from the
+// slices, not from the Header fields. Names are compressed across the whole message.
+func (m *DNSMessage) Marshal() ([]byte, error) {
+	header := m.Header
+	counts := []int{len(m.Questions), len(m.Answers), len(m.Authority), len(m.Additionals)}
+	for _, count := range counts {
+		if count > 0xFFFF {
+			return nil, fmt.Errorf("%d entries don't fit in a section", count)
+		}
+	}
+	header.QDCOUNT = uint16(counts[0])
+	header.ANCOUNT = uint16(counts[1])
+	header.NSCOUNT = uint16(counts[2])
+	header.ARCOUNT = uint16(counts[3])
+
+	buf := header.toBytes()
+	names := newCompressor()
+	for _, question := range m.Questions {
+		var err error
+		buf, err = names.appendName(buf, question.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(question.Type))
+		buf = binary.BigEndian.AppendUint16(buf, uint16(question.Class))
+	}
+
+	for i, section := range [][]ResourceRecord{m.Answers, m.Authority, m.Additionals} {
+		for j, record := range section {
+			var err error
+			buf, err = record.appendTo(buf, names)
+			if err != nil {
+				return nil, fmt.Errorf("%s record %d: %v", sectionNames[i], j+1, err)
+			}
+		}
+	}
+
+	if len(buf) > maxMessageSize {
+		return nil, fmt.Errorf("message is %d bytes, larger than %d", len(buf), maxMessageSize)
+	}
+
+	return buf, nil
+}
+
+// appendTo appends the record in wire format to msg, compressing its names with names.
+func (record ResourceRecord) appendTo(msg []byte, names *compressor) ([]byte, error) {
+	if record.Data == nil {
+		return nil, fmt.Errorf("%s record has no RDATA", record.Type)
+	}
+
+	buf, err := names.appendName(msg, record.Name)
+	if err != nil {
+		return nil, err
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(record.Type))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(record.Class))
+	buf = binary.BigEndian.AppendUint32(buf, record.TTL)
+
+	// Reserve RDLENGTH and fill it in once the RDATA is encoded
+	start := len(buf) + 2
+	buf, err = record.Data.encode(append(buf, 0, 0), names)
+	if err != nil {
+		return nil, fmt.Errorf("%s RDATA: %v", record.Type, err)
+	}
+	if len(buf)-start > 0xFFFF {
+		return nil, fmt.Errorf("%s RDATA of %d bytes is too long", record.Type, len(buf)-start)
+	}
+	binary.BigEndian.PutUint16(buf[start-2:start], uint16(len(buf)-start))
+
+	return buf, nil
+}
+
+// decodeHeader decodes the 12-byte header at the start of buf as it is, unlike
+// parseDNSHeader which derives a response header from a query.
+func decodeHeader(buf []byte) DNSHeader {
+	flags := messageFlags(buf)
+	bit := func(flag headerFlags) uint16 {
+		if flags.has(flag) {
+			return 1
+		}
+		return 0
+	}
+
+	return DNSHeader{
+		ID:      binary.BigEndian.Uint16(buf[0:2]),
+		QR:      bit(flagQR),
+		OPCODE:  flags.opcode(),
+		AA:      bit(flagAA),
+		TC:      bit(flagTC),
+		RD:      bit(flagRD),
+		RA:      bit(flagRA),
+		Z:       uint16(flags>>4) & 0x07,
+		RCODE:   flags.rcode(),
+		QDCOUNT: binary.BigEndian.Uint16(buf[4:6]),
+		ANCOUNT: binary.BigEndian.Uint16(buf[6:8]),
+		NSCOUNT: binary.BigEndian.Uint16(buf[8:10]),
+		ARCOUNT: binary.BigEndian.Uint16(buf[10:12]),
+	}
+}
+
+// parseRecord decodes the resource record at offset and returns it with the offset of the next one.
+func parseRecord(buf []byte, offset int) (ResourceRecord, int, error) {
+	name, typeOffset, err := parseDomainName(buf, offset)
+	if err != nil {
+		return ResourceRecord{}, 0, err
+	}
+	end, err := skipRecord(buf, offset)
+	if err != nil {
+		return ResourceRecord{}, 0, err
+	}
+
+	record := ResourceRecord{
+		Name:     name,
+		Type:     QType(binary.BigEndian.Uint16(buf[typeOffset : typeOffset+2])),
+		Class:    QClass(binary.BigEndian.Uint16(buf[typeOffset+2 : typeOffset+4])),
+		TTL:      binary.BigEndian.Uint32(buf[typeOffset+4 : typeOffset+8]),
+		RDLength: binary.BigEndian.Uint16(buf[typeOffset+8 : typeOffset+10]),
+	}
+	record.Data, err = decodeRDATA(buf, record.Type, typeOffset+10, end)
+	if err != nil {
+		return ResourceRecord{}, 0, fmt.Errorf("%s RDATA: %v", record.Type, err)
+	}
+
+	return record, end, nil
+}
+
+// expandRDATA returns a copy of the RDATA between start and end with any compressed
+// names written out in full, for types without their own RDATA implementation. Only
+// the RFC 1035 types may compress their RDATA (RFC 3597 section 4).
+func expandRDATA(buf []byte, rtype QType, start int, end int) ([]byte, error) {
+	// Each layout lists the fields in order: a fixed number of bytes, or -1 for a name
+	var layout []int
+	switch rtype {
+	case 3, 4, 7, 8, 9: // MD, MF, MB, MG, MR
+		layout = []int{-1}
+	case 14: // MINFO
+		layout = []int{-1, -1}
+	default:
+		return append([]byte{}, buf[start:end]...), nil
+	}
+
+	rdata := []byte{}
+	offset := start
+	for _, field := range layout {
+		if field >= 0 {
+			if offset+field > end {
+				return nil, fmt.Errorf("runs past its RDLENGTH")
+			}
+			rdata = append(rdata, buf[offset:offset+field]...)
+			offset += field
+			continue
+		}
+
+		name, next, err := parseDomainName(buf[:end], offset)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := encodeName(name)
+		if err != nil {
+			return nil, err
+		}
+		rdata = append(rdata, encoded...)
+		offset = next
+	}
+	if offset != end {
+		return nil, fmt.Errorf("%d bytes left over after the last field", end-offset)
+	}
+
+	return rdata, nil
+}
+
+// encodeName encodes a name like encodeDomainName, but fails on names that can't be
+// represented on the wire: empty labels, labels over 63 bytes or names over 255 bytes.
+func encodeName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" {
+				return nil, fmt.Errorf("name has an empty label")
+			}
+			if len(label) > 63 {
+				return nil, fmt.Errorf("name has a label longer than 63 bytes")
+			}
+		}
+	}
+
+	encoded := encodeDomainName(name)
+	if len(encoded) > 255 {
+		return nil, fmt.Errorf("name is longer than 255 bytes")
+	}
+
+	return encoded, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the expected dumps and fields of the packets in testdata")
+
+// goldenMessage is a decoded packet of testdata field by field, as kept in the .json
+// file next to it. Types and classes are given by name and RDATA by the fields of its
+// type, with SvcParam values in presentation form and unknown RDATA in hex. OPT
+// records have their EDNS fields unpacked.
+type goldenMessage struct {
+	Header      DNSHeader
+	Questions   []goldenQuestion
+	Answers     []goldenRecord
+	Authority   []goldenRecord
+	Additionals []goldenRecord
+}
+
+type goldenQuestion struct {
+	Name  string
+	Type  string
+	Class string
+}
+
+type goldenRecord struct {
+	Name  string
+	Type  string
+	Class string
+	TTL   uint32
+	RDATA any         `json:",omitempty"`
+	EDNS  *goldenEDNS `json:",omitempty"` // instead of RDATA for OPT records
+}
+
+type goldenEDNS struct {
+	UDPSize       uint16
+	ExtendedRCode uint8
+	Version       uint8
+	DO            bool
+	Options       []goldenOption
+}
+
+type goldenOption struct {
+	Code uint16
+	Data string // hex
+}
+
+type goldenSVCB struct {
+	Priority uint16
+	Target   string
+	Params   []goldenSvcParam
+}
+
+type goldenSvcParam struct {
+	Key   string
+	Value string // hex if it doesn't decode
+}
+
+// newGoldenMessage lays out a decoded message as its .json file has it.
+func newGoldenMessage(msg DNSMessage) goldenMessage {
+	golden := goldenMessage{
+		Header:      msg.Header,
+		Questions:   []goldenQuestion{},
+		Answers:     newGoldenRecords(msg.Answers),
+		Authority:   newGoldenRecords(msg.Authority),
+		Additionals: newGoldenRecords(msg.Additionals),
+	}
+	for _, q := range msg.Questions {
+		golden.Questions = append(golden.Questions, goldenQuestion{Name: q.Name, Type: q.Type.String(), Class: q.Class.String()})
+	}
+
+	return golden
+}
+
+func newGoldenRecords(records []ResourceRecord) []goldenRecord {
+	golden := []goldenRecord{}
+	for _, record := range records {
+		entry := goldenRecord{Name: record.Name, Type: record.Type.String(), Class: record.Class.String(), TTL: record.TTL}
+		switch data := record.Data.(type) {
+		case OPTData:
+			edns := ednsFromRecord(record)
+			entry.Type = "OPT" // not a QTYPE, so QType has no name for it
+			entry.EDNS = &goldenEDNS{UDPSize: edns.UDPSize, ExtendedRCode: edns.ExtendedRCode, Version: edns.Version, DO: edns.DO, Options: []goldenOption{}}
+			for _, option := range edns.Options {
+				entry.EDNS.Options = append(entry.EDNS.Options, goldenOption{Code: option.Code, Data: hex.EncodeToString(option.Data)})
+			}
+		case SVCBData:
+			svcb := goldenSVCB{Priority: data.Priority, Target: data.Target, Params: []goldenSvcParam{}}
+			for _, param := range data.Params {
+				value, ok := formatSvcParamValue(param.Key, param.Value)
+				if !ok {
+					value = hex.EncodeToString(param.Value)
+				}
+				svcb.Params = append(svcb.Params, goldenSvcParam{Key: svcParamName(param.Key), Value: value})
+			}
+			entry.RDATA = svcb
+		case UnknownData:
+			entry.RDATA = hex.EncodeToString(data)
+		default:
+			entry.RDATA = data
+		}
+		golden = append(golden, entry)
+	}
+
+	return golden
+}
+
+// jsonDiff lists the fields in which two decoded JSON values differ, by their path.
+func jsonDiff(path string, got, want any) []string {
+	switch want := want.(type) {
+	case map[string]any:
+		got, ok := got.(map[string]any)
+		if !ok {
+			return []string{fmt.Sprintf("%s: got %v, want an object", path, got)}
+		}
+		keys := []string{}
+		for key := range want {
+			keys = append(keys, key)
+		}
+		for key := range got {
+			if _, ok := want[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		diffs := []string{}
+		for _, key := range keys {
+			diffs = append(diffs, jsonDiff(path+"."+key, got[key], want[key])...)
+		}
+		return diffs
+	case []any:
+		got, ok := got.([]any)
+		if !ok || len(got) != len(want) {
+			return []string{fmt.Sprintf("%s: got %v, want %d entries", path, got, len(want))}
+		}
+
+		diffs := []string{}
+		for i := range want {
+			diffs = append(diffs, jsonDiff(fmt.Sprintf("%s[%d]", path, i), got[i], want[i])...)
+		}
+		return diffs
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		return []string{fmt.Sprintf("%s: got %v, want %v", path, got, want)}
+	}
+	return nil
+}
+
+// TestGoldenPackets runs every packet in testdata through Unmarshal and Marshal, which
+// must give back the same bytes, and compares the decoded message with the dig-style
+// dump and the fields in JSON next to it. The packets were built by hand after what
+// common servers send, as live traffic couldn't be captured where they were made:
+// queries with EDNS cookies and mixed case, and responses with compressed names in
+// owners and RDATA, EDNS, DNSSEC records, SVCB parameters and types the codec only
+// knows as raw RDATA.
+// Run with -update to rewrite the dumps and fields after a deliberate change to the
+// output.
+func TestGoldenPackets(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no packets in testdata")
+	}
+
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".bin"), func(t *testing.T) {
+			packet, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var msg DNSMessage
+			if err := msg.Unmarshal(packet); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			wire, err := msg.Marshal()
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			if !bytes.Equal(wire, packet) {
+				t.Errorf("re-encoded packet differs:\n%x\nwant:\n%x", wire, packet)
+			}
+
+			dumpPath := strings.TrimSuffix(path, ".bin") + ".txt"
+			if *updateGolden {
+				if err := os.WriteFile(dumpPath, []byte(msg.String()), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(dumpPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.String(); got != string(want) {
+				t.Errorf("decoded packet differs:\n%s\nwant:\n%s", got, want)
+			}
+
+			fields, err := json.MarshalIndent(newGoldenMessage(msg), "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fieldsPath := strings.TrimSuffix(path, ".bin") + ".json"
+			if *updateGolden {
+				if err := os.WriteFile(fieldsPath, append(fields, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(fieldsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotFields, wantFields any
+			if err := json.Unmarshal(fields, &gotFields); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(expected, &wantFields); err != nil {
+				t.Fatalf("%s: %v", fieldsPath, err)
+			}
+			for _, diff := range jsonDiff("", gotFields, wantFields) {
+				t.Errorf("decoded field %s", diff)
+			}
+		})
+	}
+}
+
+func TestDNSMessageRoundTrip(t *testing.T) {
+	question := []DNSQuestion{{Name: "example.com", Type: typeA, Class: classIN}}
+	record := func(rtype QType, data RDATA) ResourceRecord {
+		return ResourceRecord{Name: "example.com", Type: rtype, Class: classIN, TTL: 300, Data: data}
+	}
+
+	tests := []struct {
+		name string
+		msg  DNSMessage
+	}{
+		{name: "query", msg: DNSMessage{Header: DNSHeader{ID: 0xBEEF, RD: 1}, Questions: question}},
+		{name: "empty", msg: DNSMessage{Header: DNSHeader{ID: 1, QR: 1, RCODE: rcodeServFail}}},
+		{name: "flags", msg: DNSMessage{Header: DNSHeader{ID: 2, QR: 1, OPCODE: 2, AA: 1, TC: 1, RD: 1, RA: 1, RCODE: rcodeRefused}, Questions: question}},
+		{name: "answers", msg: DNSMessage{Header: DNSHeader{ID: 3, QR: 1}, Questions: question, Answers: []ResourceRecord{
+			record(typeA, AData{IP: net.IPv4(192, 0, 2, 1).To4()}),
+			record(typeAAAA, AAAAData{IP: net.ParseIP("2001:db8::1")}),
+			record(typeNS, NSData{Host: "ns1.example.com"}),
+			record(typeCNAME, CNAMEData{Target: "www.example.net"}),
+			record(typePTR, PTRData{Target: "host.example.com"}),
+			record(typeMX, MXData{Preference: 10, Exchange: "mail.example.com"}),
+			record(typeTXT, TXTData{Strings: []string{"v=spf1 -all", ""}}),
+			record(typeSRV, SRVData{Priority: 1, Weight: 2, Port: 53, Target: "ns1.example.com"}),
+			record(typeHTTPS, SVCBData{Priority: 1, Target: "", Params: []SvcParam{{Key: 1, Value: []byte("\x02h2")}, {Key: 3, Value: []byte{1, 187}}}}),
+			record(99, UnknownData{0xDE, 0xAD}),
+		}}},
+		{name: "negative", msg: DNSMessage{Header: DNSHeader{ID: 4, QR: 1, AA: 1, RCODE: rcodeNXDomain}, Questions: question, Authority: []ResourceRecord{
+			{Name: "com", Type: typeSOA, Class: classIN, TTL: 900, Data: SOAData{MName: "a.gtld-servers.net", RName: "nstld.verisign-grs.com",
+				Serial: 1, Refresh: 1800, Retry: 900, Expire: 604800, Minimum: 86400}},
+		}}},
+		{name: "EDNS", msg: DNSMessage{Header: DNSHeader{ID: 5, RD: 1}, Questions: question, Additionals: []ResourceRecord{
+			EDNS{UDPSize: 1232, DO: true, Options: []EDNSOption{{Code: 10, Data: []byte("12345678")}, {Code: 12}}}.record(),
+		}}},
+		{name: "several questions", msg: DNSMessage{Header: DNSHeader{ID: 6}, Questions: []DNSQuestion{
+			{Name: "a.example.com", Type: typeA, Class: classIN}, {Name: "b.example.com", Type: typeAAAA, Class: classIN}, {Name: "", Type: typeNS, Class: classIN},
+		}}},
+		{name: "8-bit labels", msg: DNSMessage{Header: DNSHeader{ID: 7}, Questions: []DNSQuestion{{Name: "b\xc3\xbccher.\xff.lan", Type: typeA, Class: classIN}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wire, err := tt.msg.Marshal()
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+
+			var decoded DNSMessage
+			if err := decoded.Unmarshal(wire); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if got, want := decoded.String(), tt.msg.String(); got != want {
+				t.Errorf("decoded message differs:\n%s\nwant:\n%s", got, want)
+			}
+
+			again, err := decoded.Marshal()
+			if err != nil {
+				t.Fatalf("marshal again: %v", err)
+			}
+			if !bytes.Equal(again, wire) {
+				t.Errorf("re-encoded message differs:\n%x\nwant:\n%x", again, wire)
+			}
+		})
+	}
+}
+
+func TestDNSMessageCompression(t *testing.T) {
+	msg := DNSMessage{
+		Header:    DNSHeader{ID: 1, QR: 1},
+		Questions: []DNSQuestion{{Name: "www.example.com", Type: typeA, Class: classIN}},
+		Answers: []ResourceRecord{
+			{Name: "WWW.EXAMPLE.COM", Type: typeCNAME, Class: classIN, TTL: 60, Data: CNAMEData{Target: "web.example.com"}},
+			{Name: "web.example.com", Type: typeA, Class: classIN, TTL: 60, Data: AData{IP: net.IPv4(192, 0, 2, 1).To4()}},
+		},
+	}
+	wire, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The question's name in full, then pointers: to it for the CNAME owner, "web" and a
+	// pointer to example.com for the target, and a pointer to the target for the A owner
+	want := "\x00\x01\x80\x00\x00\x01\x00\x02\x00\x00\x00\x00" +
+		"\x03www\x07example\x03com\x00\x00\x01\x00\x01" +
+		"\xc0\x0c\x00\x05\x00\x01\x00\x00\x00\x3c\x00\x06\x03web\xc0\x10" +
+		"\xc0\x2d\x00\x01\x00\x01\x00\x00\x00\x3c\x00\x04\xc0\x00\x02\x01"
+	if string(wire) != want {
+		t.Errorf("got\n%x\nwant\n%x", wire, want)
+	}
+}
+
+func TestDNSMessageUnmarshalErrors(t *testing.T) {
+	query, err := (&DNSMessage{Header: DNSHeader{ID: 1}, Questions: []DNSQuestion{{Name: "a.lan", Type: typeA, Class: classIN}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query = query[:len(query):len(query)] // so the cases below append to copies
+	opt, err := EDNS{UDPSize: 512}.record().appendTo(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCounts := func(msg []byte, ancount, arcount byte) []byte {
+		msg = append([]byte{}, msg...)
+		msg[7], msg[11] = ancount, arcount
+		return msg
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want string // part of the error
+	}{
+		{name: "short header", msg: query[:11], want: "shorter than a header"},
+		{name: "question cut short", msg: query[:len(query)-2], want: "question 1"},
+		{name: "missing record", msg: withCounts(query, 1, 0), want: "answer record 1"},
+		{name: "OPT in the answers", msg: withCounts(append(query, opt...), 1, 0), want: "OPT record in the answer section"},
+		{name: "two OPT records", msg: withCounts(append(append(query, opt...), opt...), 0, 2), want: "more than one OPT record"},
+		{name: "RDATA past the end", msg: withCounts(append(query, "\x00\x00\x01\x00\x01\x00\x00\x00\x00\x00\x04\x01"...), 1, 0), want: "answer record 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg DNSMessage
+			err := msg.Unmarshal(tt.msg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	packet, err := os.ReadFile(filepath.Join("testdata", "response-mx-compressed.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var msg DNSMessage
+		if err := msg.Unmarshal(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	packet, err := os.ReadFile(filepath.Join("testdata", "response-mx-compressed.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var msg DNSMessage
+	if err := msg.Unmarshal(packet); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
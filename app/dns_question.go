@@ -1,7 +1,76 @@
 package main
 
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// QType is the type code of a question or resource record (RFC 1035 section 3.2.2).
+type QType uint16
+
+// Record types the server handles itself; qtypeNames has their mnemonics.
+const (
+	typeA     QType = 1
+	typeNS    QType = 2
+	typeCNAME QType = 5
+	typeSOA   QType = 6
+	typePTR   QType = 12
+	typeMX    QType = 15
+	typeTXT   QType = 16
+	typeAAAA  QType = 28  // RFC 3596
+	typeSRV   QType = 33  // RFC 2782
+	typeOPT   QType = 41  // the EDNS0 OPT pseudo-record (RFC 6891)
+	typeSVCB  QType = 64  // RFC 9460
+	typeHTTPS QType = 65  // RFC 9460
+	typeANY   QType = 255 // every type the server has for a name, questions only
+)
+
+// QClass is the class code of a question or resource record (RFC 1035 section 3.2.4).
+type QClass uint16
+
+// Query classes the server distinguishes (RFC 1035 section 3.2.4, RFC 6895).
+const (
+	classIN  QClass = 1   // Internet, forwarded as usual
+	classCH  QClass = 3   // Chaos, answered from the built-ins of chaos.go
+	classANY QClass = 255 // any class, forwarded like IN
+)
+
 type DNSQuestion struct {
 	Name  string
-	Type  []byte
-	Class []byte
+	Type  QType
+	Class QClass
+}
+
+// String returns the type's mnemonic, or the generic TYPEnnn form (RFC 3597) for types we have no name for.
+func (t QType) String() string {
+	for name, qtype := range qtypeNames {
+		if qtype == t {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// String returns the class's mnemonic, or the generic CLASSnnn form (RFC 3597) for classes we have no name for.
+func (c QClass) String() string {
+	switch c {
+	case classIN:
+		return "IN"
+	case classCH:
+		return "CH"
+	case classANY:
+		return "ANY"
+	}
+
+	return fmt.Sprintf("CLASS%d", uint16(c))
+}
+
+// toBytes serializes the question into its wire format: the encoded name, then QTYPE and QCLASS.
+func (question DNSQuestion) toBytes() []byte {
+	buffer := encodeDomainName(question.Name)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(question.Type))
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(question.Class))
+
+	return buffer
 }
@@ -0,0 +1,11 @@
+package main
+
+// dohCanaryDomain is the name Firefox resolves to decide whether to enable its own
+// DNS over HTTPS; an NXDOMAIN answer tells it the network filters DNS and to keep
+// using the system resolver.
+const dohCanaryDomain = "use-application-dns.net"
+
+// isDoHCanary reports whether a question is about the DoH canary domain.
+func isDoHCanary(question DNSQuestion) bool {
+	return canonicalName(question.Name) == dohCanaryDomain
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// localUDPSize is the UDP payload size advertised in the OPT records of answers the
+// server builds itself, the size recommended to avoid fragmentation.
+const localUDPSize = 1232
+
+// EDNSOption is one option in the RDATA of an OPT record (RFC 6891 section 6.1.2).
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// OPTData is the RDATA of the OPT pseudo-record: its options, in order.
+type OPTData struct {
+	Options []EDNSOption
+}
+
+func decodeOPT(msg []byte, start int, end int) (RDATA, error) {
+	data := OPTData{}
+	for offset := start; offset < end; {
+		if end-offset < 4 {
+			return nil, fmt.Errorf("option header runs past its RDLENGTH")
+		}
+		code := binary.BigEndian.Uint16(msg[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(msg[offset+2 : offset+4]))
+		if offset+4+length > end {
+			return nil, fmt.Errorf("option %d runs past its RDLENGTH", code)
+		}
+		data.Options = append(data.Options, EDNSOption{Code: code, Data: append([]byte{}, msg[offset+4:offset+4+length]...)})
+		offset += 4 + length
+	}
+
+	return data, nil
+}
+
+func (data OPTData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	for _, option := range data.Options {
+		if len(option.Data) > 0xFFFF {
+			return nil, fmt.Errorf("option %d of %d bytes is too long", option.Code, len(option.Data))
+		}
+		buf = binary.BigEndian.AppendUint16(buf, option.Code)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(option.Data)))
+		buf = append(buf, option.Data...)
+	}
+
+	return buf, nil
+}
+
+// String lists the options one per line, as dig shows them in the OPT pseudosection.
+func (data OPTData) String() string {
+	lines := []string{}
+	for _, option := range data.Options {
+		lines = append(lines, fmt.Sprintf("; OPTION %d: %s", option.Code, hex.EncodeToString(option.Data)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// EDNS is what an OPT pseudo-record carries in the fields it repurposes: CLASS holds
+// the sender's UDP payload size and TTL the extended RCODE, version and flags.
+type EDNS struct {
+	UDPSize       uint16
+	ExtendedRCode uint8 // upper 8 bits of the 12-bit RCODE
+	Version       uint8
+	DO            bool // DNSSEC OK (RFC 3225)
+	Options       []EDNSOption
+}
+
+// ednsFromRecord unpacks an OPT record.
+func ednsFromRecord(record ResourceRecord) EDNS {
+	edns := EDNS{
+		UDPSize:       uint16(record.Class),
+		ExtendedRCode: uint8(record.TTL >> 24),
+		Version:       uint8(record.TTL >> 16),
+		DO:            record.TTL&0x8000 != 0,
+	}
+	if data, ok := record.Data.(OPTData); ok {
+		edns.Options = data.Options
+	}
+
+	return edns
+}
+
+// record packs the EDNS fields into an OPT record, owned by the root as required.
+func (edns EDNS) record() ResourceRecord {
+	ttl := uint32(edns.ExtendedRCode)<<24 | uint32(edns.Version)<<16
+	if edns.DO {
+		ttl |= 0x8000
+	}
+
+	return ResourceRecord{Name: "", Type: typeOPT, Class: QClass(edns.UDPSize), TTL: ttl, Data: OPTData{Options: edns.Options}}
+}
+
+// EDNS returns the unpacked OPT record of the message, and false if it has none.
+func (m *DNSMessage) EDNS() (EDNS, bool) {
+	for _, record := range m.Additionals {
+		if record.Type == typeOPT {
+			return ednsFromRecord(record), true
+		}
+	}
+
+	return EDNS{}, false
+}
+
+// SetEDNS replaces the OPT record of the message, or adds one at the end of the
+// additional section.
+func (m *DNSMessage) SetEDNS(edns EDNS) {
+	for i, record := range m.Additionals {
+		if record.Type == typeOPT {
+			m.Additionals[i] = edns.record()
+			return
+		}
+	}
+
+	m.Additionals = append(m.Additionals, edns.record())
+}
+
+// checkOPT enforces the placement rules of RFC 6891 section 6.1.1: at most one OPT
+// record, in the additional section, owned by the root.
+func (m *DNSMessage) checkOPT() error {
+	for i, section := range [][]ResourceRecord{m.Answers, m.Authority} {
+		for _, record := range section {
+			if record.Type == typeOPT {
+				return fmt.Errorf("OPT record in the %s section", sectionNames[i])
+			}
+		}
+	}
+
+	seen := false
+	for _, record := range m.Additionals {
+		if record.Type != typeOPT {
+			continue
+		}
+		if seen {
+			return fmt.Errorf("more than one OPT record")
+		}
+		if record.Name != "" && record.Name != "." {
+			return fmt.Errorf("OPT record not owned by the root")
+		}
+		seen = true
+	}
+
+	return nil
+}
+
+// appendOPT adds edns as an OPT record to a response built by the server, advertising
+// localUDPSize as its payload size.
+func appendOPT(response []byte, edns EDNS) []byte {
+	edns.UDPSize = localUDPSize
+	withOPT, err := edns.record().appendTo(response, nil)
+	if err != nil {
+		return response
+	}
+	binary.BigEndian.PutUint16(withOPT[10:12], binary.BigEndian.Uint16(withOPT[10:12])+1)
+
+	return withOPT
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ednsOptionECS is the EDNS Client Subnet option code (RFC 7871).
+const ednsOptionECS = 8
+
+// ednsOptionNames maps the option mnemonics accepted in --edns-option to their codes.
+var ednsOptionNames = map[string]uint16{
+	"NSID":      3,
+	"ECS":       ednsOptionECS,
+	"COOKIE":    10,
+	"KEEPALIVE": 11,
+	"PADDING":   12,
+	"MAC":       ednsOptionMAC,
+}
+
+// ednsOptionAction is what the forwarder does with a client's EDNS option.
+type ednsOptionAction int
+
+const (
+	ednsOptionPass    ednsOptionAction = iota // forward as received
+	ednsOptionStrip                           // leave out of the forwarded query
+	ednsOptionRewrite                         // forward with the configured data instead
+)
+
+// ednsOptionRule applies an action to one option code.
+type ednsOptionRule struct {
+	action ednsOptionAction
+	data   []byte // replacement data for ednsOptionRewrite
+}
+
+// EDNSOptionPolicy decides which EDNS options of client queries reach the resolvers.
+// Options without a rule are passed through as the client sent them.
+type EDNSOptionPolicy struct {
+	rules map[uint16]ednsOptionRule
+}
+
+// NewEDNSOptionPolicy creates a policy that strips the device MAC option, so the MAC
+// addresses of clients don't leak to the resolvers unless a MAC=pass rule is added.
+func NewEDNSOptionPolicy() *EDNSOptionPolicy {
+	return &EDNSOptionPolicy{rules: map[uint16]ednsOptionRule{ednsOptionMAC: {action: ednsOptionStrip}}}
+}
+
+// parseEDNSOption converts an option mnemonic (e.g. "ECS") or number into its code.
+func parseEDNSOption(name string) (uint16, error) {
+	if code, ok := ednsOptionNames[strings.ToUpper(name)]; ok {
+		return code, nil
+	}
+
+	code, err := strconv.ParseUint(name, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("unknown EDNS option %q", name)
+	}
+
+	return uint16(code), nil
+}
+
+// addRules parses a comma-separated list of OPTION=pass, OPTION=strip or
+// OPTION=rewrite:<value> entries. The value of an ECS rewrite is a network such as
+// 192.0.2.0/24, sent as the client's subnet; for other options it is hex data.
+func (p *EDNSOptionPolicy) addRules(list string) error {
+	for _, entry := range splitList(list) {
+		name, action, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("expected OPTION=pass, strip or rewrite:<value>, got %q", entry)
+		}
+		code, err := parseEDNSOption(name)
+		if err != nil {
+			return err
+		}
+
+		var rule ednsOptionRule
+		switch value, rewrite := strings.CutPrefix(action, "rewrite:"); {
+		case action == "pass":
+			rule.action = ednsOptionPass
+		case action == "strip":
+			rule.action = ednsOptionStrip
+		case rewrite && code == ednsOptionECS:
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return fmt.Errorf("invalid client subnet in %q: %v", entry, err)
+			}
+			rule = ednsOptionRule{action: ednsOptionRewrite, data: encodeClientSubnet(network)}
+		case rewrite:
+			data, err := hex.DecodeString(value)
+			if err != nil || len(data) > 0xFFFF {
+				return fmt.Errorf("invalid option data in %q, expected hex", entry)
+			}
+			rule = ednsOptionRule{action: ednsOptionRewrite, data: data}
+		default:
+			return fmt.Errorf("unknown action in %q, expected pass, strip or rewrite:<value>", entry)
+		}
+
+		if p.rules == nil {
+			p.rules = map[uint16]ednsOptionRule{}
+		}
+		p.rules[code] = rule
+	}
+
+	return nil
+}
+
+// apply returns the RDATA of a client's OPT record with the policy applied to each
+// option, keeping their order. A truncated option at the end is dropped.
+func (p *EDNSOptionPolicy) apply(rdata []byte) []byte {
+	if p == nil || len(p.rules) == 0 {
+		return rdata
+	}
+
+	result := []byte{}
+	for len(rdata) >= 4 {
+		code := binary.BigEndian.Uint16(rdata[0:2])
+		length := int(binary.BigEndian.Uint16(rdata[2:4]))
+		if 4+length > len(rdata) {
+			break
+		}
+
+		switch rule := p.rules[code]; rule.action {
+		case ednsOptionPass:
+			result = append(result, rdata[:4+length]...)
+		case ednsOptionRewrite:
+			result = binary.BigEndian.AppendUint16(result, code)
+			result = binary.BigEndian.AppendUint16(result, uint16(len(rule.data)))
+			result = append(result, rule.data...)
+		}
+		rdata = rdata[4+length:]
+	}
+
+	return result
+}
+
+// encodeClientSubnet encodes the data of an ECS option announcing network as the
+// client's subnet, with the address cut to the prefix length (RFC 7871 section 6).
+func encodeClientSubnet(network *net.IPNet) []byte {
+	prefix, _ := network.Mask.Size()
+	family, ip := uint16(2), network.IP.To16()
+	if ip4 := network.IP.To4(); ip4 != nil {
+		family, ip = 1, ip4
+	}
+
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, byte(prefix), 0) // source prefix length, scope prefix length
+	return append(data, ip[:(prefix+7)/8]...)
+}
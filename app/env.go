@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envAliases maps extra environment variable names onto flags, for names that
+// read more naturally than the derived ones.
+var envAliases = map[string]string{
+	"DNS_UPSTREAM": "resolver",
+}
+
+// envName returns the environment variable that can set a flag, e.g. DNS_EDNS_SIZE for --edns-size.
+func envName(flagName string) string {
+	return "DNS_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvOverrides sets every flag of flags that was not given on the command line
+// from its DNS_* environment variable, so containers can be configured without
+// arguments. Command-line flags take precedence over the environment, and the derived
+// name of a flag over its alias.
+func applyEnvOverrides(flags *flag.FlagSet) error {
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	values := map[string]string{}
+	for env, name := range envAliases {
+		if value, ok := os.LookupEnv(env); ok {
+			values[name] = value
+		}
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			values[f.Name] = value
+		}
+	})
+
+	for name, value := range values {
+		if explicit[name] {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %v", value, envName(name), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name         string
+		args         []string
+		env          map[string]string
+		wantResolver string
+		wantSize     int
+		wantLogging  bool
+		wantErr      bool
+	}{
+		{name: "defaults", wantResolver: "", wantSize: 1232},
+		{name: "from the environment", env: map[string]string{"DNS_RESOLVER": "1.1.1.1:53", "DNS_EDNS_SIZE": "4096", "DNS_LOG_QUERIES": "true"},
+			wantResolver: "1.1.1.1:53", wantSize: 4096, wantLogging: true},
+		{name: "alias", env: map[string]string{"DNS_UPSTREAM": "9.9.9.9:53"}, wantResolver: "9.9.9.9:53", wantSize: 1232},
+		{name: "derived name over the alias", env: map[string]string{"DNS_UPSTREAM": "9.9.9.9:53", "DNS_RESOLVER": "1.1.1.1:53"},
+			wantResolver: "1.1.1.1:53", wantSize: 1232},
+		{name: "flags over the environment", args: []string{"--resolver", "8.8.8.8:53", "--edns-size=512"},
+			env:          map[string]string{"DNS_RESOLVER": "1.1.1.1:53", "DNS_UPSTREAM": "9.9.9.9:53", "DNS_EDNS_SIZE": "4096", "DNS_LOG_QUERIES": "1"},
+			wantResolver: "8.8.8.8:53", wantSize: 512, wantLogging: true},
+		{name: "flag set to its default over the environment", args: []string{"--log-queries=false"}, env: map[string]string{"DNS_LOG_QUERIES": "true"},
+			wantSize: 1232},
+		{name: "invalid value", env: map[string]string{"DNS_EDNS_SIZE": "big"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			resolver := flags.String("resolver", "", "")
+			size := flags.Int("edns-size", 1232, "")
+			logging := flags.Bool("log-queries", false, "")
+			if err := flags.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyEnvOverrides(flags)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error, want one")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if *resolver != tt.wantResolver || *size != tt.wantSize || *logging != tt.wantLogging {
+				t.Errorf("got resolver %q, EDNS size %d and query logging %v, want %q, %d and %v",
+					*resolver, *size, *logging, tt.wantResolver, tt.wantSize, tt.wantLogging)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Forwarder holds the resolvers queries are relayed to and how they are queried.
+type Forwarder struct {
+	Upstreams    []*Upstream       // tried in order
+	EDNSSize     uint16            // UDP payload size advertised upstream, 0 disables EDNS
+	EDNSFallback bool              // retry without EDNS if every resolver rejects the EDNS query
+	EDNSOptions  *EDNSOptionPolicy // which client EDNS options are forwarded, nil passes all
+
+	QTypeUpstreams map[QType][]*Upstream  // tried in order instead of Upstreams for these QTYPEs
+	ZoneUpstreams  map[string][]*Upstream // the same for names at or below these stub zones
+	InsecureZones  map[string]bool        // zones queried with CD set, so they aren't validated upstream
+}
+
+// addQTypeRoutes parses a comma-separated list of TYPE=<ip>:<port> entries, sending
+// queries of each TYPE to its resolvers instead of the default ones. A TYPE listed
+// more than once gets its resolvers in the order given.
+func (f *Forwarder) addQTypeRoutes(list string) error {
+	for _, entry := range splitList(list) {
+		name, address, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("expected TYPE=<ip>:<port>, got %q", entry)
+		}
+		qtype, err := parseQType(name)
+		if err != nil {
+			return err
+		}
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return fmt.Errorf("invalid resolver address in %q: %v", entry, err)
+		}
+
+		if f.QTypeUpstreams == nil {
+			f.QTypeUpstreams = map[QType][]*Upstream{}
+		}
+		f.QTypeUpstreams[qtype] = append(f.QTypeUpstreams[qtype], NewUpstream(addr))
+	}
+
+	return nil
+}
+
+// isRetryableRCODE reports whether an upstream RCODE means another attempt may succeed.
+// FORMERR and NOTIMP are typical answers from servers that do not understand EDNS.
+func isRetryableRCODE(rcode RCode) bool {
+	return rcode == rcodeFormErr || rcode == rcodeNotImp
+}
+
+// withoutEDNS builds the query to forward upstream from the header and questions only.
+func withoutEDNS(query []byte, offset int) []byte {
+	forwarded := append([]byte{}, query[:offset]...)
+	binary.BigEndian.PutUint16(forwarded[6:8], 0)   // ANCOUNT
+	binary.BigEndian.PutUint16(forwarded[8:10], 0)  // NSCOUNT
+	binary.BigEndian.PutUint16(forwarded[10:12], 0) // ARCOUNT
+
+	return forwarded
+}
+
+// upstreamsFor returns the resolvers for a query: the servers of the closest stub zone
+// of its name, if any, or else those routed its QTYPE, or else the default ones.
+func (f *Forwarder) upstreamsFor(query []byte, offset int) []*Upstream {
+	questions, _, err := parseQuestions(query[:offset], 12, int(binary.BigEndian.Uint16(query[4:6])))
+	if err != nil || len(questions) == 0 {
+		return f.Upstreams
+	}
+
+	if len(f.ZoneUpstreams) > 0 {
+		for _, zone := range enclosingZones(questions[0].Name) {
+			if upstreams, ok := f.ZoneUpstreams[zone]; ok {
+				return upstreams
+			}
+		}
+	}
+	if upstreams, ok := f.QTypeUpstreams[questions[0].Type]; ok {
+		return upstreams
+	}
+
+	return f.Upstreams
+}
+
+// available returns the upstreams that are not marked down. If every upstream is down,
+// all of them are returned so that queries are still attempted rather than dropped.
+func available(all []*Upstream) []*Upstream {
+	upstreams := []*Upstream{}
+	for _, upstream := range all {
+		if !upstream.isDown() {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	if len(upstreams) == 0 {
+		return all
+	}
+
+	return upstreams
+}
+
+// resolve forwards a query whose question section ends at offset to each resolver in turn,
+// moving on when a resolver fails or answers FORMERR/NOTIMP. If EDNS is enabled and every
+// resolver rejected it, the round is repeated without an OPT record when EDNSFallback is set.
+// When no resolver gives a usable answer, the last error response received is returned.
+// Resolvers marked down are skipped while another one is available. Queries of a QTYPE
+// with its own resolvers only go to those. A resolver with as many queries outstanding
+// as it's allowed is skipped too, except the last one, where the query waits its turn.
+func (f *Forwarder) resolve(query []byte, offset int) ([]byte, error) {
+	attempts := [][]byte{withoutEDNS(query, offset)}
+	if f.EDNSSize > 0 {
+		attempts = [][]byte{withEDNS(query, offset, f.EDNSSize, f.EDNSOptions)}
+		if f.EDNSFallback {
+			attempts = append(attempts, withoutEDNS(query, offset))
+		}
+	}
+
+	// DNSSEC records are relayed as received; insecure zones just ask not to be checked
+	questions, _, err := parseQuestions(query[:offset], 12, 1)
+	if err == nil && f.isInsecure(questions[0].Name) {
+		for _, forwarded := range attempts {
+			forwarded[3] |= byte(flagCD)
+		}
+	}
+
+	var lastResponse []byte
+	lastErr := fmt.Errorf("no resolvers configured")
+	upstreams := available(f.upstreamsFor(query, offset))
+	for _, forwarded := range attempts {
+		for i, upstream := range upstreams {
+			// Move on from a resolver at its limit; the last one is waited for instead
+			wait := time.Duration(0)
+			if i == len(upstreams)-1 {
+				wait = upstreamTimeout
+			}
+			if !upstream.reserve(wait) {
+				lastErr = fmt.Errorf("resolver %s is busy", upstream.Addr)
+				continue
+			}
+
+			resolverAddr := upstream.Addr
+			response, err := upstream.exchange(forwarded)
+			upstream.unreserve()
+			if err != nil {
+				fmt.Printf("Resolver %s failed: %v\n", resolverAddr, err)
+				if isUnreachable(err) {
+					upstream.recordUnreachable()
+				} else {
+					upstream.recordFailure()
+				}
+				lastErr = err
+				continue
+			}
+			upstream.recordSuccess()
+
+			if len(response) >= 12 && isRetryableRCODE(messageRCode(response)) {
+				fmt.Printf("Resolver %s answered %s, trying next\n", resolverAddr, messageRCode(response))
+				lastResponse = response
+				continue
+			}
+
+			return response, nil
+		}
+	}
+
+	if lastResponse != nil {
+		return lastResponse, nil
+	}
+
+	return nil, lastErr
+}
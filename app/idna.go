@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Punycode parameters (RFC 3492 section 5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// acePrefix marks a label as the punycode form (A-label) of a Unicode label.
+const acePrefix = "xn--"
+
+// toASCII converts a name to the form it has on the wire, turning each Unicode label
+// into its A-label (RFC 5891 section 4). Labels are lowercased first, and must then be
+// made of letters, digits, combining marks and inner hyphens as IDNA2008 requires.
+// ASCII labels, and labels that aren't UTF-8 at all, are left as they are. Errors
+// give the position of the label, not the name, which callers add if they may.
+func toASCII(name string) (string, error) {
+	if isASCII(name) {
+		return name, nil
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if isASCII(label) || !utf8.ValidString(label) {
+			continue
+		}
+
+		label = strings.ToLower(label)
+		if err := checkULabel(label); err != nil {
+			return "", fmt.Errorf("label %d %v", i+1, err)
+		}
+		encoded, err := punycodeEncode(label)
+		if err != nil {
+			return "", fmt.Errorf("label %d %v", i+1, err)
+		}
+		if len(acePrefix+encoded) > 63 {
+			return "", fmt.Errorf("label %d is %d bytes as an A-label, longer than 63", i+1, len(acePrefix+encoded))
+		}
+		labels[i] = acePrefix + encoded
+	}
+
+	return strings.Join(labels, "."), nil
+}
+
+// toUnicode converts the A-labels of a name back to Unicode, for display. Labels
+// that don't decode to a valid Unicode label with the same A-label are left as they are.
+func toUnicode(name string) string {
+	if !strings.Contains(strings.ToLower(name), acePrefix) {
+		return name
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		encoded, ok := strings.CutPrefix(strings.ToLower(label), acePrefix)
+		if !ok {
+			continue
+		}
+		decoded, err := punycodeDecode(encoded)
+		if err != nil || checkULabel(decoded) != nil {
+			continue
+		}
+		if again, err := punycodeEncode(decoded); err != nil || again != encoded {
+			continue
+		}
+		labels[i] = decoded
+	}
+
+	return strings.Join(labels, ".")
+}
+
+// canonicalName returns a name as names are compared: without the trailing dot and
+// with its case folded by foldCase. Names are taken as they are on the wire; names
+// from the configuration go through parseName first, so a Unicode name there matches
+// its A-labels in queries, while raw 8-bit labels in a query match only themselves.
+func canonicalName(name string) string {
+	return foldCase(strings.TrimSuffix(name, "."))
+}
+
+// foldCase lowercases the ASCII letters of a name and leaves every other byte as it
+// is, which is how DNS compares names (RFC 4343 section 3). strings.ToLower would
+// also fold non-ASCII letters and turn bytes that aren't UTF-8 into U+FFFD, making
+// distinct wire names equal.
+func foldCase(name string) string {
+	for i := 0; i < len(name); i++ {
+		if 'A' <= name[i] && name[i] <= 'Z' {
+			folded := []byte(name)
+			for j := i; j < len(folded); j++ {
+				if 'A' <= folded[j] && folded[j] <= 'Z' {
+					folded[j] += 'a' - 'A'
+				}
+			}
+			return string(folded)
+		}
+	}
+
+	return name
+}
+
+// checkULabel checks a lowercased Unicode label against the rules of RFC 5891 section
+// 5.4 that can be checked without the IDNA2008 tables: no hyphens at either end or in
+// the third and fourth positions, no leading combining mark, and only letters, digits,
+// combining marks and hyphens.
+func checkULabel(label string) error {
+	runes := []rune(label)
+	if len(runes) == 0 {
+		return fmt.Errorf("is empty")
+	}
+	if runes[0] == '-' || runes[len(runes)-1] == '-' {
+		return fmt.Errorf("starts or ends with a hyphen")
+	}
+	if len(runes) >= 4 && runes[2] == '-' && runes[3] == '-' {
+		return fmt.Errorf("has hyphens in the third and fourth positions")
+	}
+	if unicode.Is(unicode.M, runes[0]) {
+		return fmt.Errorf("starts with a combining mark")
+	}
+
+	for _, r := range runes {
+		switch {
+		case r == '-', unicode.IsDigit(r), unicode.Is(unicode.M, r):
+		case unicode.IsLetter(r) && !unicode.IsUpper(r):
+		default:
+			return fmt.Errorf("contains %U, which IDNA doesn't allow", r)
+		}
+	}
+
+	return nil
+}
+
+// isASCII reports whether s has only ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// punycodeEncode encodes a Unicode label with punycode, without the ACE prefix (RFC 3492 section 6.3).
+func punycodeEncode(label string) (string, error) {
+	runes := []rune(label)
+	output := []byte{}
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			output = append(output, byte(r))
+		}
+	}
+	basic := len(output)
+	if basic > 0 {
+		output = append(output, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled := basic; handled < len(runes); {
+		// The next code point to insert is the smallest one not handled yet
+		next := math.MaxInt32
+		for _, r := range runes {
+			if int(r) >= n && int(r) < next {
+				next = int(r)
+			}
+		}
+		if next-n > (math.MaxInt32-delta)/(handled+1) {
+			return "", fmt.Errorf("overflows punycode")
+		}
+		delta += (next - n) * (handled + 1)
+		n = next
+
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				output = append(output, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			output = append(output, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+
+	return string(output), nil
+}
+
+// punycodeDecode decodes a punycode label given without the ACE prefix (RFC 3492 section 6.2).
+func punycodeDecode(encoded string) (string, error) {
+	output := []rune{}
+	if i := strings.LastIndexByte(encoded, '-'); i >= 0 {
+		for _, c := range encoded[:i] {
+			if c >= utf8.RuneSelf {
+				return "", fmt.Errorf("non-ASCII character in punycode %q", encoded)
+			}
+			output = append(output, c)
+		}
+		encoded = encoded[i+1:]
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos := 0; pos < len(encoded); {
+		oldI, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", fmt.Errorf("punycode %q ends in the middle of a number", encoded)
+			}
+			digit, ok := punyDigitValue(encoded[pos])
+			pos++
+			if !ok {
+				return "", fmt.Errorf("invalid character %q in punycode", encoded[pos-1])
+			}
+			if digit > (math.MaxInt32-i)/w {
+				return "", fmt.Errorf("punycode %q overflows", encoded)
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > math.MaxInt32/(punyBase-t) {
+				return "", fmt.Errorf("punycode %q overflows", encoded)
+			}
+			w *= punyBase - t
+		}
+
+		count := len(output) + 1
+		bias = punyAdapt(i-oldI, count, oldI == 0)
+		if i/count > math.MaxInt32-n {
+			return "", fmt.Errorf("punycode %q overflows", encoded)
+		}
+		n += i / count
+		i %= count
+		if n > unicode.MaxRune || (n >= 0xD800 && n <= 0xDFFF) {
+			return "", fmt.Errorf("punycode %q decodes to an invalid code point", encoded)
+		}
+		output = append(output[:i], append([]rune{rune(n)}, output[i:]...)...)
+		i++
+	}
+
+	return string(output), nil
+}
+
+// punyThreshold returns the threshold t for the digit at position k of a number.
+func punyThreshold(k int, bias int) int {
+	return min(max(k-bias, punyTMin), punyTMax)
+}
+
+// punyAdapt is the bias adaptation function of RFC 3492 section 6.1.
+func punyAdapt(delta int, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyDigit returns the character for a punycode digit: a-z for 0-25, 0-9 for 26-35.
+func punyDigit(digit int) byte {
+	if digit < 26 {
+		return byte('a' + digit)
+	}
+
+	return byte('0' + digit - 26)
+}
+
+// punyDigitValue returns the value of a punycode digit character, in either case.
+func punyDigitValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+
+	return 0, false
+}
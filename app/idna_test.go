@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPunycode(t *testing.T) {
+	tests := []struct {
+		label   string
+		encoded string
+	}{
+		{label: "münchen", encoded: "mnchen-3ya"},
+		{label: "bücher", encoded: "bcher-kva"},
+		{label: "abc", encoded: "abc-"},
+		{label: "ü", encoded: "tda"},
+		// Sample strings of RFC 3492 section 7.1
+		{label: "他们为什么不说中文", encoded: "ihqwcrb4cv8a8dqg056pqjye"},
+		{label: "почемужеонинеговорятпорусски", encoded: "b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+		{label: "pročprostěnemluvíčesky", encoded: "Proprostnemluvesky-uyb24dma41a"},
+		{label: "3年b組金八先生", encoded: "3B-ww4c5e180e575a65lsy2b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoded, func(t *testing.T) {
+			encoded, err := punycodeEncode(tt.label)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			// The RFC samples keep the case of their basic code points, which doesn't change the rest
+			if !strings.EqualFold(encoded, tt.encoded) {
+				t.Errorf("punycodeEncode(%q) = %q, want %q", tt.label, encoded, tt.encoded)
+			}
+
+			decoded, err := punycodeDecode(tt.encoded)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !strings.EqualFold(decoded, tt.label) {
+				t.Errorf("punycodeDecode(%q) = %q, want %q", tt.encoded, decoded, tt.label)
+			}
+		})
+	}
+}
+
+func TestPunycodeDecodeInvalid(t *testing.T) {
+	for _, encoded := range []string{
+		"a-b!",        // not a punycode digit
+		"mnchen-3y",   // ends in the middle of a number
+		"ü-tda",       // non-ASCII basic code point
+		"99999999999", // overflows
+	} {
+		if decoded, err := punycodeDecode(encoded); err == nil {
+			t.Errorf("punycodeDecode(%q) = %q, want an error", encoded, decoded)
+		}
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "example.com", want: "example.com"},
+		{name: "münchen.de", want: "xn--mnchen-3ya.de"},
+		{name: "MÜNCHEN.de", want: "xn--mnchen-3ya.de"},
+		{name: "www.bücher.example", want: "www.xn--bcher-kva.example"},
+		{name: "-ü.de", wantErr: true},
+		{name: "üa--b.de", wantErr: true},
+		{name: "́a.de", wantErr: true},         // leading combining mark
+		{name: "ü☃.de", wantErr: true},         // a symbol
+		{name: "\xffab.de", want: "\xffab.de"}, // not UTF-8, left as it is
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toASCII(tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if back := toUnicode(got); strings.Contains(got, acePrefix) && back != strings.ToLower(tt.name) {
+				t.Errorf("toUnicode(%q) = %q, want %q", got, back, strings.ToLower(tt.name))
+			}
+		})
+	}
+}
+
+func TestCanonicalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "WwW.Example.COM.", want: "www.example.com"},
+		{name: "XN--MNCHEN-3YA.de", want: "xn--mnchen-3ya.de"},
+		{name: "MÜNCHEN.de", want: "mÜnchen.de"},     // wire names aren't converted, only ASCII is folded
+		{name: "\xff\xC3.LAN", want: "\xff\xc3.lan"}, // bytes that aren't UTF-8 are kept
+		{name: "", want: ""},
+		{name: ".", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := canonicalName(tt.name); got != tt.want {
+			t.Errorf("canonicalName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	if canonicalName("\xfe.lan") == canonicalName("\xff.lan") {
+		t.Error("distinct 8-bit names compare equal")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// overloadPolicy is what happens to a query that arrives while the in-flight limit is reached.
+type overloadPolicy int
+
+const (
+	overloadDrop   overloadPolicy = iota // ignore the query, the client retries
+	overloadRefuse                       // answer REFUSED
+	overloadQueue                        // wait for a free slot, dropping the query after a deadline
+)
+
+// parseOverloadPolicy converts the --overload flag value into a policy.
+func parseOverloadPolicy(policy string) (overloadPolicy, error) {
+	switch policy {
+	case "drop":
+		return overloadDrop, nil
+	case "refuse":
+		return overloadRefuse, nil
+	case "queue":
+		return overloadQueue, nil
+	}
+
+	return overloadDrop, fmt.Errorf("unknown overload policy %q, expected drop, refuse or queue", policy)
+}
+
+// InflightLimiter caps how many queries are processed at once, so a flood of queries
+// can't grow memory and goroutines without bound. A nil limiter admits everything.
+type InflightLimiter struct {
+	slots  chan struct{}
+	policy overloadPolicy
+	wait   time.Duration // how long overloadQueue waits for a slot
+
+	rejected atomic.Uint64 // queries turned away, for the overload log
+}
+
+// NewInflightLimiter creates a limiter for max concurrent queries, or nil if max is 0.
+func NewInflightLimiter(max int, policy overloadPolicy, wait time.Duration) *InflightLimiter {
+	if max == 0 {
+		return nil
+	}
+
+	return &InflightLimiter{slots: make(chan struct{}, max), policy: policy, wait: wait}
+}
+
+// acquire takes a slot for a query, waiting for one under overloadQueue. It reports
+// false if the query must be turned away; otherwise release must be called once the
+// query is answered.
+func (l *InflightLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.policy == overloadQueue {
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return true
+		case <-timer.C:
+		}
+	}
+
+	// Log the start of an overload and then every 1000 queries, not every one
+	if rejected := l.rejected.Add(1); rejected%1000 == 1 {
+		fmt.Printf("Overloaded: %d queries in flight, %d turned away so far\n", cap(l.slots), rejected)
+	}
+
+	return false
+}
+
+// release frees the slot taken by acquire.
+func (l *InflightLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// admit takes an in-flight slot for a query, to be given back with finish. When none
+// is available the query is dropped or, under overloadRefuse, answered REFUSED, and
+// admit reports false.
+func (s *Server) admit(req *RequestContext, query []byte) bool {
+	if s.Inflight.acquire() {
+		s.pending.Add(1)
+		return true
+	}
+
+	if s.Inflight.policy == overloadRefuse && len(query) >= 12 {
+		header := parseDNSHeader(query)
+		if _, offset, err := parseQuestions(query, 12, int(header.QDCOUNT)); err == nil {
+			if err := req.respond(buildEmptyResponse(query, offset, header, rcodeRefused)); err != nil {
+				fmt.Println("Failed to send overload response:", err)
+			}
+		}
+	}
+
+	return false
+}
+
+// finish gives back the slot admit took once the query is answered.
+func (s *Server) finish() {
+	s.Inflight.release()
+	s.pending.Done()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// IPNames answers names under configured zones that embed an IP address, as the xip.io
+// and nip.io services do, so wildcard development domains work without any records.
+// Under the zone myapp.test, each of
+//
+//	10-0-0-5.myapp.test
+//	app-10-0-0-5.myapp.test
+//	app.10.0.0.5.myapp.test
+//	fd00--5.myapp.test
+//
+// is answered with the address it spells, an IPv6 one having its colons written as
+// dashes. Names under the zones that spell no address are left to the resolvers.
+type IPNames struct {
+	zones []string // lowercased, without trailing dot
+	ttl   uint32   // TTL of the answers
+}
+
+// NewIPNames creates the synthetic answers for names under the given zones, answered
+// with the given TTL.
+func NewIPNames(zones []string, ttl uint32) *IPNames {
+	ipNames := &IPNames{ttl: ttl}
+	for _, zone := range zones {
+		ipNames.zones = append(ipNames.zones, canonicalName(zone))
+	}
+
+	return ipNames
+}
+
+// answer returns the A or AAAA record for a question about a name that embeds an
+// address. The boolean is false if the name spells no address under one of the zones;
+// QTYPEs other than the address's own get no records (NODATA).
+func (n *IPNames) answer(question DNSQuestion) ([]ResourceRecord, bool) {
+	if question.Class != classIN && question.Class != classANY {
+		return nil, false
+	}
+
+	name := canonicalName(question.Name)
+	for _, zone := range n.zones {
+		prefix, ok := strings.CutSuffix(name, "."+zone)
+		if !ok {
+			continue
+		}
+		ip := embeddedIP(strings.Split(prefix, "."))
+		if ip == nil {
+			continue
+		}
+
+		records := []ResourceRecord{}
+		record := ResourceRecord{Name: question.Name, Type: question.Type, Class: classIN, TTL: n.ttl}
+		switch {
+		case ip.To4() != nil && (question.Type == typeA || question.Type == typeANY):
+			record.Type = typeA
+			record.Data = AData{IP: ip.To4()}
+			records = append(records, record)
+		case ip.To4() == nil && (question.Type == typeAAAA || question.Type == typeANY):
+			record.Type = typeAAAA
+			record.Data = AAAAData{IP: ip}
+			records = append(records, record)
+		}
+		return records, true
+	}
+
+	return nil, false
+}
+
+// embeddedIP returns the address spelled by the labels in front of a zone: the last
+// four labels as a dotted IPv4 address, or the last label as a dashed IPv4 address,
+// optionally after a prefix, or as an IPv6 address with dashes for colons.
+func embeddedIP(labels []string) net.IP {
+	if len(labels) >= 4 {
+		if ip := net.ParseIP(strings.Join(labels[len(labels)-4:], ".")); ip != nil && ip.To4() != nil {
+			return ip
+		}
+	}
+
+	label := labels[len(labels)-1]
+	if parts := strings.Split(label, "-"); len(parts) >= 4 {
+		if ip := net.ParseIP(strings.Join(parts[len(parts)-4:], ".")); ip != nil && ip.To4() != nil {
+			return ip
+		}
+	}
+	if ip := net.ParseIP(strings.ReplaceAll(label, "-", ":")); ip != nil && ip.To4() == nil {
+		return ip
+	}
+
+	return nil
+}
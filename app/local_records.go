@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxCNAMEChain is how many aliases are followed for one answer before giving up.
+const maxCNAMEChain = 8
+
+// LocalRecords is a static set of records loaded from a file and answered
+// authoritatively. Each line of the file holds one record as
+//
+//	<name> [<ttl>] <type> <value...>
+//
+// for example "nas.lan 300 AAAA fd00::10". Records without a TTL get the default,
+// which a "$TTL <seconds>" line changes for the records that follow it, as in zone
+// files (RFC 2308 section 4), so each zone in the file can have its own.
+// Blank lines and lines starting with # are ignored. Values with spaces are quoted,
+// as in `mail.lan TXT "v=spf1 mx -all"`.
+// A name with a CNAME record can't have any other record (RFC 1034 section 3.6.2).
+// A name with an SOA record starts a local zone: names in it that the file doesn't
+// define are answered NXDOMAIN instead of being forwarded, and negative answers
+// carry the SOA. Names with nothing of their own but names defined below them, such
+// as b.lan when only a.b.lan is defined, exist as empty non-terminals and get NODATA
+// there instead, since NXDOMAIN would deny everything below them (RFC 8020).
+// The addresses of A and AAAA records also answer reverse lookups with PTR records,
+// unless the file defines the reverse name itself.
+//
+// A name starting with "*." is a wildcard for every name below it, such as
+// "*.dev.lan" for "app.dev.lan" and "a.b.dev.lan", and a name written as "~<regexp>"
+// matches every name the regular expression matches in full, ignoring case and the
+// trailing dot. Both synthesize answers owned by the name asked for. A name's own
+// records come first, then those of the closest wildcard above it, then those of the
+// first matching regexp in the file. Unlike RFC 4592, a wildcard also covers names
+// that have records of their own below it.
+type LocalRecords struct {
+	records      map[string][]ResourceRecord // by lowercased name without trailing dot, wildcards included
+	patterns     []localPattern              // in file order
+	nonTerminals map[string]bool             // names without records that have names with records below them
+}
+
+// localPattern holds the records of a regexp owner in the records file.
+type localPattern struct {
+	source  string
+	re      *regexp.Regexp
+	records []ResourceRecord
+}
+
+// LoadLocalRecords reads the records file at path, with defaultTTL for records that
+// don't set one until a $TTL line. An empty path gives an empty set.
+func LoadLocalRecords(path string, defaultTTL uint32) (*LocalRecords, error) {
+	local := &LocalRecords{records: map[string][]ResourceRecord{}}
+	if path == "" {
+		return local, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open records file: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields, err := splitRecordFields(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+
+		if fields[0] == "$TTL" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected $TTL <seconds>", path, line)
+			}
+			if defaultTTL, err = parseTTL(fields[1]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+			continue
+		}
+
+		record, err := parseLocalRecord(fields, defaultTTL)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if err := local.add(record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read records file: %v", err)
+	}
+	local.addReverse()
+	local.addNonTerminals()
+
+	return local, nil
+}
+
+// addNonTerminals records the empty non-terminals of the loaded names: every name
+// above a defined name, or above a wildcard, that has no records of its own.
+func (l *LocalRecords) addNonTerminals() {
+	l.nonTerminals = map[string]bool{}
+	for key := range l.records {
+		for name := key; ; {
+			_, parent, found := strings.Cut(name, ".")
+			if !found {
+				break
+			}
+			if len(l.records[parent]) == 0 {
+				l.nonTerminals[parent] = true
+			}
+			name = parent
+		}
+	}
+}
+
+// isNonTerminal reports whether a name has no records but names below it do.
+func (l *LocalRecords) isNonTerminal(name string) bool {
+	return l.nonTerminals[canonicalName(name)]
+}
+
+// addReverse adds a PTR record for the address of every A and AAAA record with a
+// plain name, so reverse lookups of local addresses find their names. Address names
+// the file defines itself are left as they are.
+func (l *LocalRecords) addReverse() {
+	defined := map[string]bool{}
+	keys := []string{}
+	for key := range l.records {
+		defined[key] = true
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // so several names for one address are always answered in the same order
+
+	for _, key := range keys {
+		for _, record := range l.records[key] {
+			var ip net.IP
+			switch data := record.Data.(type) {
+			case AData:
+				ip = data.IP
+			case AAAAData:
+				ip = data.IP
+			default:
+				continue
+			}
+			if strings.HasPrefix(record.Name, "*") {
+				continue
+			}
+
+			reverse := reverseName(ip)
+			if defined[reverse] {
+				continue
+			}
+			l.records[reverse] = append(l.records[reverse], ResourceRecord{Name: reverse, Type: typePTR, Class: classIN, TTL: record.TTL,
+				Data: PTRData{Target: strings.TrimSuffix(record.Name, ".")}})
+		}
+	}
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name for an address (RFC 1035
+// section 3.5, RFC 3596 section 2.5).
+func reverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	const hexDigits = "0123456789abcdef"
+	labels := make([]string, 0, 2*net.IPv6len+2)
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		labels = append(labels, string(hexDigits[ip16[i]&0x0F]), string(hexDigits[ip16[i]>>4]))
+	}
+
+	return strings.Join(append(labels, "ip6", "arpa"), ".")
+}
+
+// splitRecordFields splits a line of the records file at whitespace, except inside
+// double quotes, which let a TXT value hold spaces. Inside quotes a backslash escapes
+// the next character, such as a quote.
+func splitRecordFields(line string) ([]string, error) {
+	fields := []string{}
+	var field strings.Builder
+	inField, quoted, escaped := false, false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
+
+// add adds a record parsed from the records file under its name, wildcard or regexp.
+func (l *LocalRecords) add(record ResourceRecord) error {
+	source, isPattern := strings.CutPrefix(record.Name, "~")
+	if !isPattern {
+		key := canonicalName(record.Name)
+		records, err := appendLocalRecord(l.records[key], record)
+		if err != nil {
+			return err
+		}
+		l.records[key] = records
+		return nil
+	}
+
+	for i := range l.patterns {
+		if l.patterns[i].source == source {
+			records, err := appendLocalRecord(l.patterns[i].records, record)
+			if err != nil {
+				return err
+			}
+			l.patterns[i].records = records
+			return nil
+		}
+	}
+	if _, err := regexp.Compile(source); err != nil {
+		return fmt.Errorf("invalid regexp: %v", err)
+	}
+	re := regexp.MustCompile("(?i)^(?:" + source + ")$")
+	l.patterns = append(l.patterns, localPattern{source: source, re: re, records: []ResourceRecord{record}})
+
+	return nil
+}
+
+// appendLocalRecord appends record to the records of one owner, which can't mix a
+// CNAME with anything else.
+func appendLocalRecord(existing []ResourceRecord, record ResourceRecord) ([]ResourceRecord, error) {
+	if len(existing) > 0 && (record.Type == typeCNAME || existing[0].Type == typeCNAME) {
+		return nil, fmt.Errorf("%s has a CNAME record and can't have other records", record.Name)
+	}
+
+	return append(existing, record), nil
+}
+
+// parseLocalRecord parses the fields of one line of the records file, giving the
+// record ttl unless the line sets its own.
+func parseLocalRecord(fields []string, ttl uint32) (ResourceRecord, error) {
+	line := strings.Join(fields, " ")
+	name := fields[0]
+	fields = fields[1:]
+	if len(fields) > 0 && strings.Trim(fields[0], "0123456789") == "" {
+		var err error
+		if ttl, err = parseTTL(fields[0]); err != nil {
+			return ResourceRecord{}, err
+		}
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return ResourceRecord{}, fmt.Errorf("expected <name> [<ttl>] <type> <value>, got %q", line)
+	}
+
+	rtype, err := parseQType(fields[0])
+	if err != nil {
+		return ResourceRecord{}, err
+	}
+	data, err := parseLocalRDATA(rtype, fields[1:])
+	if err != nil {
+		return ResourceRecord{}, fmt.Errorf("invalid %s record for %s: %v", rtype, name, err)
+	}
+
+	record := ResourceRecord{Name: name, Type: rtype, Class: classIN, TTL: ttl, Data: data}
+	if strings.HasPrefix(name, "~") {
+		return record, nil
+	}
+	if record.Name, err = parseName(name); err != nil {
+		return ResourceRecord{}, err
+	}
+	if strings.Contains(strings.TrimPrefix(name, "*."), "*") {
+		return ResourceRecord{}, fmt.Errorf("name %q can only have * as its first label", name)
+	}
+
+	return record, nil
+}
+
+// parseLocalRDATA parses the RDATA of a record in the records file, either in the
+// presentation form of its type or in the generic \# form, which any type can use.
+// Types with their own RDATA implementation get it in both cases.
+func parseLocalRDATA(rtype QType, fields []string) (RDATA, error) {
+	if fields[0] == `\#` {
+		raw, err := parseUnknownData(fields)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rdataDecoders[rtype]; !ok {
+			return raw, nil
+		}
+		return decodeRDATA(raw, rtype, 0, len(raw))
+	}
+
+	parse, ok := rdataParsers[rtype]
+	if !ok {
+		return nil, fmt.Errorf(`%s records can only be given in the generic \# <length> <hex> form`, rtype)
+	}
+
+	return parse(fields)
+}
+
+// parseTTL parses a TTL in seconds, which must fit in 31 bits (RFC 2181 section 8).
+func parseTTL(value string) (uint32, error) {
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || ttl > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid TTL %q, expected 0 to %d seconds", value, math.MaxInt32)
+	}
+
+	return uint32(ttl), nil
+}
+
+// answer returns the records for a question about a locally defined name, with the
+// owner name spelled as in the question. An alias is answered with its CNAME record
+// followed by the answer for the target, as far as the chain stays in local data and
+// doesn't loop.
+// The boolean is false if the name is not defined locally; a defined name without
+// records of the QTYPE gets none (NODATA).
+func (l *LocalRecords) answer(question DNSQuestion) ([]ResourceRecord, bool) {
+	if !l.has(question.Name) || (question.Class != classIN && question.Class != classANY) {
+		return nil, false
+	}
+
+	records := []ResourceRecord{}
+	name := question.Name
+	visited := map[string]bool{}
+	for len(visited) <= maxCNAMEChain && l.has(name) {
+		key := canonicalName(name)
+		if visited[key] { // the chain loops back on itself
+			break
+		}
+		visited[key] = true
+		defined, _ := l.lookup(name)
+
+		// Follow an alias, unless the CNAME itself is what was asked for
+		if alias := defined[0]; alias.Type == typeCNAME && question.Type != typeCNAME && question.Type != typeANY {
+			alias.Name = name
+			records = append(records, alias)
+			name = alias.Data.(CNAMEData).Target
+			continue
+		}
+
+		for _, record := range defined {
+			if question.Type == record.Type || question.Type == typeANY {
+				record.Name = name
+				records = append(records, record)
+			}
+		}
+		break
+	}
+
+	return records, true
+}
+
+// has reports whether any record is defined for a name, directly or through a
+// wildcard or regexp.
+func (l *LocalRecords) has(name string) bool {
+	_, ok := l.lookup(name)
+	return ok
+}
+
+// lookup returns the records that answer for a name: its own, or else those of the
+// closest wildcard above it, or else those of the first regexp matching it.
+func (l *LocalRecords) lookup(name string) ([]ResourceRecord, bool) {
+	key := canonicalName(name)
+	if records := l.records[key]; len(records) > 0 {
+		return records, true
+	}
+
+	for parent := key; parent != ""; {
+		_, parent, _ = strings.Cut(parent, ".")
+		wildcard := "*"
+		if parent != "" {
+			wildcard = "*." + parent
+		}
+		if records := l.records[wildcard]; len(records) > 0 {
+			return records, true
+		}
+	}
+
+	for _, pattern := range l.patterns {
+		if pattern.re.MatchString(key) {
+			return pattern.records, true
+		}
+	}
+
+	return nil, false
+}
+
+// zoneSOA returns the SOA record of the closest zone above or at a name in the local
+// data, for the authority section of a negative answer. Its TTL is lowered to the
+// zone's minimum, which bounds how long the negative answer is cached (RFC 2308
+// section 5).
+func (l *LocalRecords) zoneSOA(question DNSQuestion) (ResourceRecord, bool) {
+	if question.Class != classIN && question.Class != classANY {
+		return ResourceRecord{}, false
+	}
+
+	for zone := canonicalName(question.Name); ; {
+		for _, record := range l.records[zone] {
+			if soa, ok := record.Data.(SOAData); ok {
+				record.TTL = min(record.TTL, soa.Minimum)
+				return record, true
+			}
+		}
+		if zone == "" {
+			return ResourceRecord{}, false
+		}
+		_, zone, _ = strings.Cut(zone, ".")
+	}
+}
+
+// aliasTarget returns the target of the CNAME that ends an answer, when the answer
+// stops at an alias instead of reaching records of the asked type.
+func aliasTarget(records []ResourceRecord, question DNSQuestion) (string, bool) {
+	if len(records) == 0 || question.Type == typeCNAME || question.Type == typeANY {
+		return "", false
+	}
+
+	cname, ok := records[len(records)-1].Data.(CNAMEData)
+	return cname.Target, ok
+}
+
+// resolveAlias asks the resolvers about the target of a local alias and returns their
+// RCODE, answer and authority records, so the client gets the whole chain in one
+// response and learns when its end doesn't exist. Failures are logged and give
+// SERVFAIL, leaving the answer ending at the CNAME.
+func (s *Server) resolveAlias(id uint16, target string, question DNSQuestion) (RCode, []ResourceRecord, []ResourceRecord) {
+	msg := DNSMessage{
+		Header:    DNSHeader{ID: id, RD: 1},
+		Questions: []DNSQuestion{{Name: target, Type: question.Type, Class: question.Class}},
+	}
+	query, err := msg.Marshal()
+	if err != nil {
+		fmt.Printf("Failed to build query for alias target %s: %v\n", logName(target), err)
+		return rcodeServFail, nil, nil
+	}
+
+	response, err := s.Forwarder.resolve(query, len(query))
+	if err != nil {
+		fmt.Printf("Failed to resolve alias target %s: %v\n", logName(target), err)
+		return rcodeServFail, nil, nil
+	}
+	normalizeTTLs(response, s.MaxTTL)
+
+	var reply DNSMessage
+	if err := reply.Unmarshal(response); err != nil {
+		fmt.Printf("Failed to parse answer for alias target %s: %v\n", logName(target), err)
+		return rcodeServFail, nil, nil
+	}
+
+	return reply.Header.RCODE, reply.Answers, reply.Authority
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// localCase is a question for the local records and the response it must get.
+type localCase struct {
+	name          string
+	qname         string
+	qtype         QType
+	wantRCode     RCode
+	wantAnswer    []string // records as "<owner> <ttl> <class> <type> <rdata>"
+	wantAuthority []string
+	wantRefused   bool // left to the resolvers, which local-only mode refuses
+}
+
+// writeRecordsFile writes records to a records file for the test and returns its path.
+func writeRecordsFile(t *testing.T, records string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "records")
+	if err := os.WriteFile(path, []byte(records), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// newLocalServer returns a server answering from records, loaded as a records file, in
+// local-only mode, so every name the local data doesn't answer is refused instead of
+// forwarded.
+func newLocalServer(t *testing.T, records string) *Server {
+	t.Helper()
+
+	local, err := LoadLocalRecords(writeRecordsFile(t, records), 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{
+		Forwarder: &Forwarder{EDNSOptions: &EDNSOptionPolicy{}},
+		Policy:    &QTypePolicy{},
+		SelfNames: NewSelfNames(nil, 60),
+		Records:   local,
+		IPNames:   NewIPNames(nil, 60),
+	}
+	server.mode.Store(int32(modeLocalOnly))
+
+	return server
+}
+
+// lookupLocal sends a query for name through handleQuery of a server answering from
+// records, as newLocalServer makes it, and returns the response.
+func lookupLocal(t *testing.T, records string, name string, qtype QType) DNSMessage {
+	t.Helper()
+
+	server := newLocalServer(t, records)
+
+	query, err := (&DNSMessage{Header: DNSHeader{ID: 1, RD: 1}, Questions: []DNSQuestion{{Name: name, Type: qtype, Class: classIN}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg DNSMessage
+	if err := msg.Unmarshal(handle(server, query)); err != nil {
+		t.Fatalf("response doesn't parse: %v", err)
+	}
+
+	return msg
+}
+
+// handle runs a query through handleQuery as if it came from a local UDP client and
+// returns the response, nil if there was none.
+func handle(server *Server, query []byte) []byte {
+	var response []byte
+	req := &RequestContext{
+		ClientAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353},
+		Transport:  TransportUDP,
+		write: func(msg []byte) error {
+			response = msg
+			return nil
+		},
+	}
+	server.handleQuery(req, query)
+
+	return response
+}
+
+// recordLines renders records as their dig lines with single spaces.
+func recordLines(records []ResourceRecord) []string {
+	lines := []string{}
+	for _, record := range records {
+		lines = append(lines, strings.Join(strings.Fields(record.String()), " "))
+	}
+
+	return lines
+}
+
+// runLocalCases checks the response to each case against the records file records.
+func runLocalCases(t *testing.T, records string, tests []localCase) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := lookupLocal(t, records, tt.qname, tt.qtype)
+			if tt.wantRefused {
+				if msg.Header.RCODE != rcodeRefused || msg.Header.AA != 0 {
+					t.Errorf("got %s with AA %d, want it left to the resolvers", msg.Header.RCODE, msg.Header.AA)
+				}
+				return
+			}
+
+			if msg.Header.RCODE != tt.wantRCode || msg.Header.AA != 1 {
+				t.Errorf("got %s with AA %d, want an authoritative %s", msg.Header.RCODE, msg.Header.AA, tt.wantRCode)
+			}
+			if got, want := strings.Join(recordLines(msg.Answers), "\n"), strings.Join(tt.wantAnswer, "\n"); got != want {
+				t.Errorf("got answer:\n%s\nwant:\n%s", got, want)
+			}
+			if got, want := strings.Join(recordLines(msg.Authority), "\n"), strings.Join(tt.wantAuthority, "\n"); got != want {
+				t.Errorf("got authority:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestLocalRecordsAddresses(t *testing.T) {
+	records := "nas.lan A 10.0.0.10\n" +
+		"nas.lan AAAA fd00::10\n" +
+		"printer.lan. A 10.0.0.20\n"
+
+	runLocalCases(t, records, []localCase{
+		{name: "A", qname: "nas.lan", qtype: typeA, wantAnswer: []string{"nas.lan. 60 IN A 10.0.0.10"}},
+		{name: "AAAA", qname: "nas.lan", qtype: typeAAAA, wantAnswer: []string{"nas.lan. 60 IN AAAA fd00::10"}},
+		{name: "ANY", qname: "nas.lan", qtype: typeANY, wantAnswer: []string{"nas.lan. 60 IN A 10.0.0.10", "nas.lan. 60 IN AAAA fd00::10"}},
+		{name: "owner spelled as asked", qname: "NAS.Lan", qtype: typeA, wantAnswer: []string{"NAS.Lan. 60 IN A 10.0.0.10"}},
+		{name: "trailing dot in the file", qname: "printer.lan", qtype: typeA, wantAnswer: []string{"printer.lan. 60 IN A 10.0.0.20"}},
+		{name: "NODATA for another type", qname: "printer.lan", qtype: typeAAAA},
+		{name: "undefined name", qname: "tv.lan", qtype: typeA, wantRefused: true},
+		{name: "name below a defined one", qname: "www.nas.lan", qtype: typeA, wantRefused: true},
+	})
+}
+
+func TestLoadLocalRecordsInvalid(t *testing.T) {
+	for _, records := range []string{
+		"nas.lan A fd00::10\n",    // IPv6 address in an A record
+		"nas.lan AAAA 10.0.0.1\n", // IPv4 address in an AAAA record
+		"nas.lan A\n",             // no value
+		"nas.lan BOGUS 1\n",       // unknown type
+	} {
+		if _, err := LoadLocalRecords(writeRecordsFile(t, records), 60); err == nil {
+			t.Errorf("loaded %q, want an error", records)
+		}
+	}
+}
+
+func TestLocalRecordsCNAME(t *testing.T) {
+	records := "www.lan CNAME web.lan\n" +
+		"web.lan CNAME nas.lan\n" +
+		"nas.lan A 10.0.0.10\n" +
+		"ext.lan CNAME example.com\n" +
+		"loop1.lan CNAME loop2.lan\n" +
+		"loop2.lan CNAME loop1.lan\n"
+	for i := 0; i < 10; i++ {
+		records += "chain" + strconv.Itoa(i) + ".lan CNAME chain" + strconv.Itoa(i+1) + ".lan\n"
+	}
+	records += "chain10.lan A 10.0.0.99\n"
+
+	chain := []string{}
+	for i := 0; i <= maxCNAMEChain; i++ {
+		chain = append(chain, "chain"+strconv.Itoa(i)+".lan. 60 IN CNAME chain"+strconv.Itoa(i+1)+".lan.")
+	}
+
+	runLocalCases(t, records, []localCase{
+		{name: "chain to a local address", qname: "www.lan", qtype: typeA, wantAnswer: []string{
+			"www.lan. 60 IN CNAME web.lan.", "web.lan. 60 IN CNAME nas.lan.", "nas.lan. 60 IN A 10.0.0.10"}},
+		{name: "target without the type", qname: "www.lan", qtype: typeAAAA, wantAnswer: []string{
+			"www.lan. 60 IN CNAME web.lan.", "web.lan. 60 IN CNAME nas.lan."}},
+		{name: "CNAME asked for", qname: "www.lan", qtype: typeCNAME, wantAnswer: []string{"www.lan. 60 IN CNAME web.lan."}},
+		{name: "ANY not followed", qname: "www.lan", qtype: typeANY, wantAnswer: []string{"www.lan. 60 IN CNAME web.lan."}},
+		{name: "owner spelled as asked", qname: "WWW.lan", qtype: typeA, wantAnswer: []string{
+			"WWW.lan. 60 IN CNAME web.lan.", "web.lan. 60 IN CNAME nas.lan.", "nas.lan. 60 IN A 10.0.0.10"}},
+		{name: "target outside the local data", qname: "ext.lan", qtype: typeA, wantAnswer: []string{"ext.lan. 60 IN CNAME example.com."}},
+		{name: "loop", qname: "loop1.lan", qtype: typeA, wantAnswer: []string{
+			"loop1.lan. 60 IN CNAME loop2.lan.", "loop2.lan. 60 IN CNAME loop1.lan."}},
+		{name: "longer than the limit", qname: "chain0.lan", qtype: typeA, wantAnswer: chain},
+	})
+}
+
+func TestLoadLocalRecordsCNAMEConflict(t *testing.T) {
+	for _, records := range []string{
+		"www.lan CNAME web.lan\nwww.lan A 10.0.0.1\n",
+		"www.lan A 10.0.0.1\nwww.lan CNAME web.lan\n",
+		"www.lan CNAME web.lan\nwww.lan CNAME nas.lan\n",
+	} {
+		if _, err := LoadLocalRecords(writeRecordsFile(t, records), 60); err == nil {
+			t.Errorf("loaded %q, want an error", records)
+		}
+	}
+}
+
+func TestLocalRecordsTTL(t *testing.T) {
+	records := "default.lan A 10.0.0.1\n" +
+		"own.lan 300 A 10.0.0.2\n" +
+		"$TTL 120\n" +
+		"zone.lan A 10.0.0.3\n" +
+		"zone.lan 0 AAAA fd00::3\n"
+
+	runLocalCases(t, records, []localCase{
+		{name: "default", qname: "default.lan", qtype: typeA, wantAnswer: []string{"default.lan. 60 IN A 10.0.0.1"}},
+		{name: "own TTL", qname: "own.lan", qtype: typeA, wantAnswer: []string{"own.lan. 300 IN A 10.0.0.2"}},
+		{name: "after $TTL", qname: "zone.lan", qtype: typeA, wantAnswer: []string{"zone.lan. 120 IN A 10.0.0.3"}},
+		{name: "own TTL after $TTL", qname: "zone.lan", qtype: typeAAAA, wantAnswer: []string{"zone.lan. 0 IN AAAA fd00::3"}},
+	})
+}
+
+func TestLoadLocalRecordsInvalidTTL(t *testing.T) {
+	for _, records := range []string{
+		"a.lan 2147483648 A 10.0.0.1\n", // over 31 bits
+		"$TTL\n",
+		"$TTL 1h\n",
+		"$TTL 60 120\n",
+	} {
+		if _, err := LoadLocalRecords(writeRecordsFile(t, records), 60); err == nil {
+			t.Errorf("loaded %q, want an error", records)
+		}
+	}
+}
+
+func TestLocalRecordsWildcardsAndRegexps(t *testing.T) {
+	records := "*.dev.lan A 10.0.1.1\n" +
+		"*.b.dev.lan A 10.0.1.2\n" +
+		"own.dev.lan A 10.0.1.3\n" +
+		"own.dev.lan TXT mine\n" +
+		"*.alias.lan CNAME nas.lan\n" +
+		"nas.lan A 10.0.0.10\n" +
+		`~host-[0-9]+\.lan A 10.0.2.1` + "\n" +
+		`~host-.*\.lan A 10.0.2.2` + "\n" +
+		`~.*\.dev\.lan A 10.0.2.3` + "\n"
+
+	runLocalCases(t, records, []localCase{
+		{name: "wildcard before a matching regexp", qname: "app.dev.lan", qtype: typeA, wantAnswer: []string{"app.dev.lan. 60 IN A 10.0.1.1"}},
+		{name: "several labels below a wildcard", qname: "x.y.dev.lan", qtype: typeA, wantAnswer: []string{"x.y.dev.lan. 60 IN A 10.0.1.1"}},
+		{name: "closest wildcard", qname: "x.b.dev.lan", qtype: typeA, wantAnswer: []string{"x.b.dev.lan. 60 IN A 10.0.1.2"}},
+		{name: "wildcard under a name with records", qname: "x.own.dev.lan", qtype: typeA, wantAnswer: []string{"x.own.dev.lan. 60 IN A 10.0.1.1"}},
+		{name: "own records before a wildcard", qname: "own.dev.lan", qtype: typeA, wantAnswer: []string{"own.dev.lan. 60 IN A 10.0.1.3"}},
+		{name: "NODATA from own records, not the wildcard", qname: "own.dev.lan", qtype: typeAAAA},
+		{name: "wildcard owner not matched by its parent", qname: "dev.lan", qtype: typeA, wantRefused: true},
+		{name: "wildcard alias", qname: "x.alias.lan", qtype: typeA, wantAnswer: []string{
+			"x.alias.lan. 60 IN CNAME nas.lan.", "nas.lan. 60 IN A 10.0.0.10"}},
+		{name: "regexp", qname: "host-12.lan", qtype: typeA, wantAnswer: []string{"host-12.lan. 60 IN A 10.0.2.1"}},
+		{name: "regexp ignores case", qname: "HOST-12.LAN", qtype: typeA, wantAnswer: []string{"HOST-12.LAN. 60 IN A 10.0.2.1"}},
+		{name: "first matching regexp", qname: "host-x.lan", qtype: typeA, wantAnswer: []string{"host-x.lan. 60 IN A 10.0.2.2"}},
+		{name: "regexp matches the whole name", qname: "myhost-1.lan", qtype: typeA, wantRefused: true},
+	})
+}
+
+func TestLoadLocalRecordsInvalidPatterns(t *testing.T) {
+	for _, records := range []string{
+		"a.*.lan A 10.0.0.1\n", // * not the first label
+		"*a.lan A 10.0.0.1\n",  // * in a label
+		"~host-( A 10.0.0.1\n", // invalid regexp
+		"~host A 10.0.0.1\n~host CNAME nas.lan\n",
+	} {
+		if _, err := LoadLocalRecords(writeRecordsFile(t, records), 60); err == nil {
+			t.Errorf("loaded %q, want an error", records)
+		}
+	}
+}
+
+func TestLocalRecordsNegativeAnswers(t *testing.T) {
+	records := "lan 3600 SOA ns.lan admin.lan 1 3600 600 86400 300\n" +
+		"nas.lan A 10.0.0.10\n" +
+		"ext.lan CNAME example.com\n" +
+		"lab.lan 60 SOA ns.lab.lan admin.lan 7 3600 600 86400 900\n" +
+		"pc.lab.lan A 10.0.3.1\n"
+	lanSOA := "lan. 300 IN SOA ns.lan. admin.lan. 1 3600 600 86400 300"
+	labSOA := "lab.lan. 60 IN SOA ns.lab.lan. admin.lan. 7 3600 600 86400 900"
+
+	runLocalCases(t, records, []localCase{
+		{name: "NXDOMAIN in the zone", qname: "tv.lan", qtype: typeA, wantRCode: rcodeNXDomain, wantAuthority: []string{lanSOA}},
+		{name: "NODATA in the zone", qname: "nas.lan", qtype: typeAAAA, wantAuthority: []string{lanSOA}},
+		{name: "answer without the SOA", qname: "nas.lan", qtype: typeA, wantAnswer: []string{"nas.lan. 60 IN A 10.0.0.10"}},
+		{name: "alias leaving the zone", qname: "ext.lan", qtype: typeA, wantAnswer: []string{"ext.lan. 60 IN CNAME example.com."}},
+		{name: "SOA asked for", qname: "lan", qtype: typeSOA, wantAnswer: []string{"lan. 3600 IN SOA ns.lan. admin.lan. 1 3600 600 86400 300"}},
+		{name: "closest zone", qname: "tv.lab.lan", qtype: typeA, wantRCode: rcodeNXDomain, wantAuthority: []string{labSOA}},
+		{name: "TTL below the minimum kept", qname: "pc.lab.lan", qtype: typeAAAA, wantAuthority: []string{labSOA}},
+		{name: "outside every zone", qname: "example.com", qtype: typeA, wantRefused: true},
+	})
+}
+
+func TestLocalRecordsReverse(t *testing.T) {
+	records := "nas.lan 300 A 10.0.0.10\n" +
+		"nas.lan AAAA fd00::10\n" +
+		"files.lan A 10.0.0.10\n" +
+		"*.dev.lan A 10.0.0.30\n" +
+		"printer.lan A 10.0.0.20\n" +
+		"20.0.0.10.in-addr.arpa PTR office-printer.lan\n"
+
+	runLocalCases(t, records, []localCase{
+		// Names of one address in name order, as an RRset with the lowest TTL of its records
+		{name: "IPv4", qname: "10.0.0.10.in-addr.arpa", qtype: typePTR, wantAnswer: []string{
+			"10.0.0.10.in-addr.arpa. 60 IN PTR files.lan.", "10.0.0.10.in-addr.arpa. 60 IN PTR nas.lan."}},
+		{name: "IPv6", qname: "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", qtype: typePTR, wantAnswer: []string{
+			"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. 60 IN PTR nas.lan."}},
+		{name: "defined in the file", qname: "20.0.0.10.in-addr.arpa", qtype: typePTR, wantAnswer: []string{
+			"20.0.0.10.in-addr.arpa. 60 IN PTR office-printer.lan."}},
+		{name: "none for a wildcard", qname: "30.0.0.10.in-addr.arpa", qtype: typePTR, wantRefused: true},
+	})
+}
+
+func TestLocalRecordsEmptyNonTerminals(t *testing.T) {
+	records := "lan SOA ns.lan admin.lan 1 3600 600 86400 300\n" +
+		"a.b.c.lan A 10.0.0.1\n" +
+		"*.dev.lan A 10.0.0.2\n" +
+		"~host-[0-9]+\\.site\\.lan A 10.0.0.3\n" +
+		"nas.lan A 10.0.0.10\n"
+	soa := "lan. 60 IN SOA ns.lan. admin.lan. 1 3600 600 86400 300"
+
+	runLocalCases(t, records, []localCase{
+		{name: "parent of a name", qname: "b.c.lan", qtype: typeA, wantAuthority: []string{soa}},
+		{name: "grandparent of a name", qname: "c.lan", qtype: typeA, wantAuthority: []string{soa}},
+		// The SOA's names are compressed against the question, taking its case
+		{name: "in another case", qname: "B.C.Lan", qtype: typeA, wantAuthority: []string{"Lan. 60 IN SOA ns.Lan. admin.Lan. 1 3600 600 86400 300"}},
+		{name: "parent of a wildcard", qname: "dev.lan", qtype: typeA, wantAuthority: []string{soa}},
+		{name: "sibling of a name", qname: "x.c.lan", qtype: typeA, wantRCode: rcodeNXDomain, wantAuthority: []string{soa}},
+		{name: "below a name", qname: "x.nas.lan", qtype: typeA, wantRCode: rcodeNXDomain, wantAuthority: []string{soa}},
+		{name: "not for regexps", qname: "site.lan", qtype: typeA, wantRCode: rcodeNXDomain, wantAuthority: []string{soa}},
+	})
+}
+
+func TestLocalRecordsChainTTL(t *testing.T) {
+	records := "www.lan 30 CNAME web.lan\n" +
+		"web.lan 600 CNAME nas.lan\n" +
+		"nas.lan 300 A 10.0.0.10\n" +
+		"nas.lan 300 A 10.0.0.11\n"
+
+	runLocalCases(t, records, []localCase{
+		{name: "lowest TTL of the chain", qname: "www.lan", qtype: typeA, wantAnswer: []string{
+			"www.lan. 30 IN CNAME web.lan.", "web.lan. 30 IN CNAME nas.lan.", "nas.lan. 30 IN A 10.0.0.10", "nas.lan. 30 IN A 10.0.0.11"}},
+		{name: "middle of the chain", qname: "web.lan", qtype: typeA, wantAnswer: []string{
+			"web.lan. 300 IN CNAME nas.lan.", "nas.lan. 300 IN A 10.0.0.10", "nas.lan. 300 IN A 10.0.0.11"}},
+	})
+}
+
+func TestLocalRecordsUnicodeNames(t *testing.T) {
+	records := "bücher.lan A 10.0.0.1\n" +
+		"www.lan CNAME bücher.lan\n"
+
+	runLocalCases(t, records, []localCase{
+		{name: "A-labels", qname: "xn--bcher-kva.lan", qtype: typeA, wantAnswer: []string{"xn--bcher-kva.lan. 60 IN A 10.0.0.1"}},
+		{name: "A-labels in another case", qname: "XN--BCHER-KVA.lan", qtype: typeA, wantAnswer: []string{"XN--BCHER-KVA.lan. 60 IN A 10.0.0.1"}},
+		{name: "alias target converted", qname: "www.lan", qtype: typeA, wantAnswer: []string{
+			"www.lan. 60 IN CNAME xn--bcher-kva.lan.", "xn--bcher-kva.lan. 60 IN A 10.0.0.1"}},
+		{name: "raw UTF-8 on the wire", qname: "bücher.lan", qtype: typeA, wantRefused: true},
+	})
+}
@@ -3,55 +3,310 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"strings"
+	"time"
 )
 
 func main() {
 	// Command-line arguments
 	var resolver string
-	flag.StringVar(&resolver, "resolver", "", "DNS resolver address in the form <ip>:<port>")
+	var qtypeResolvers string
+	var stubZones string
+	var insecureZones string
+	var listen string
+	var listenUnixPath string
+	var canaries string
+	var ednsSize uint
+	var ednsFallback bool
+	var ednsOptions string
+	var refuseQTypes string
+	var nodataQTypes string
+	var selfNames string
+	var ipZones string
+	var recordsFile string
+	var localTTL uint
+	var mdnsBridge bool
+	var logQNames string
+	var identifyDevices bool
+	var macSources string
+	var maxTTL uint
+	var dohCanary bool
+	var trace bool
+	var maxInflight uint
+	var overload string
+	var overloadWait time.Duration
+	var mode string
+	var upstreamInflight uint
+	var mirror string
+	var mirrorRate float64
+	var mirrorCompare bool
+	var serveTCP bool
+	var maxStreamConns uint
+	flag.StringVar(&resolver, "resolver", "", "Comma-separated DNS resolver addresses in the form <ip>:<port>, tried in order")
+	flag.StringVar(&qtypeResolvers, "qtype-resolver", "", "Comma-separated TYPE=<ip>:<port> entries sending queries of a QTYPE to other resolvers, tried in order")
+	flag.StringVar(&stubZones, "stub-zone", "", "Comma-separated ZONE=<ip>:<port> entries sending queries for names in a ZONE to its own servers")
+	flag.StringVar(&insecureZones, "insecure-zone", "", "Comma-separated zones forwarded with CD set so upstream resolvers don't DNSSEC-validate them")
+	flag.StringVar(&listen, "listen", "127.0.0.1:2053", "Address to serve DNS on, in the form <ip>:<port>")
+	flag.BoolVar(&serveTCP, "tcp", true, "Also serve DNS over TCP on the --listen address, where clients retry truncated answers")
+	flag.StringVar(&listenUnixPath, "listen-unix", "", "Path of a Unix stream socket to also serve DNS on, with TCP-style length prefixes")
+	flag.UintVar(&maxStreamConns, "max-stream-conns", 256, "Most TCP and Unix socket connections served at once, beyond which new ones wait to be accepted (0 for no limit)")
+	flag.StringVar(&canaries, "canary", "", "Comma-separated names to resolve through the resolver on startup")
+	flag.UintVar(&ednsSize, "edns-size", 1232, "EDNS UDP payload size advertised to the resolver (0 disables EDNS)")
+	flag.BoolVar(&ednsFallback, "edns-fallback", true, "Retry without EDNS when every resolver answers FORMERR or NOTIMP")
+	flag.StringVar(&ednsOptions, "edns-option", "", "Comma-separated OPTION=pass, OPTION=strip or OPTION=rewrite:<value> rules for client EDNS options, e.g. ECS=strip,COOKIE=pass; MAC is stripped unless passed")
+	flag.StringVar(&refuseQTypes, "refuse-qtype", "", "Comma-separated QTYPEs to answer with REFUSED, each optionally scoped as TYPE@<cidr> or TYPE@<mac>")
+	flag.StringVar(&nodataQTypes, "nodata-qtype", "", "Comma-separated QTYPEs to answer with an empty NOERROR, each optionally scoped as TYPE@<cidr> or TYPE@<mac>")
+	flag.StringVar(&selfNames, "self-names", "", "Comma-separated hostnames answered with this server's own interface addresses")
+	flag.StringVar(&ipZones, "ip-names", "", "Comma-separated zones whose names embed an IP address, such as 10-0-0-5.<zone>, answered with that address")
+	flag.StringVar(&recordsFile, "records", "", "File of local records to answer authoritatively, one \"<name> <type> <value>\" per line")
+	flag.UintVar(&localTTL, "local-ttl", 60, "TTL in seconds of answers for self names and IP names, and of records that don't set one")
+	flag.BoolVar(&mdnsBridge, "mdns-bridge", false, "Resolve .local names by asking the LAN over multicast DNS")
+	flag.StringVar(&logQNames, "log-qnames", "full", "How much of client query names to log: full, domain or none")
+	flag.BoolVar(&identifyDevices, "identify-devices", false, "Identify client devices by MAC from EDNS option 65001 (only from --mac-sources) or the ARP table")
+	flag.StringVar(&macSources, "mac-sources", "", "Comma-separated networks or addresses of the CPE and forwarders trusted to pass device MACs in EDNS option 65001")
+	flag.UintVar(&maxTTL, "max-ttl", 604800, "Cap in seconds for TTLs in relayed responses (0 disables the cap)")
+	flag.BoolVar(&dohCanary, "doh-canary", false, "Answer use-application-dns.net with NXDOMAIN so browsers keep using this server (implied by QTYPE filtering)")
+	flag.BoolVar(&trace, "trace", false, "Log a dig-style dump of every query received and response sent, names included")
+	flag.UintVar(&maxInflight, "max-inflight", 1024, "Most queries processed at once (0 for no limit)")
+	flag.StringVar(&overload, "overload", "drop", "What to do with queries beyond --max-inflight: drop, refuse or queue")
+	flag.DurationVar(&overloadWait, "overload-wait", 100*time.Millisecond, "How long a query waits for a slot with --overload queue before it is dropped")
+	flag.StringVar(&mode, "mode", "normal", "What to answer: normal, local-only (no forwarding) or maintenance (SERVFAIL for everything); SIGUSR1 switches to the next mode and SIGHUP back to normal")
+	flag.UintVar(&upstreamInflight, "upstream-max-inflight", 0, "Most queries outstanding to each resolver at once, beyond which the next one is tried (0 for no limit)")
+	flag.StringVar(&mirror, "mirror", "", "Resolver address, in the form <ip>:<port>, to copy forwarded queries to in the background; its answers are discarded")
+	flag.Float64Var(&mirrorRate, "mirror-rate", 1, "Fraction of forwarded queries copied to --mirror, between 0 and 1")
+	flag.BoolVar(&mirrorCompare, "mirror-compare", false, "Compare the answers of --mirror with the resolvers' and log any difference in RCODE or answer records, redacted as --log-qnames says")
 	flag.Parse()
 
+	// Every flag can also be set through a DNS_* environment variable
+	if err := applyEnvOverrides(flag.CommandLine); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	if resolver == "" {
-		fmt.Println("Usage: ./your_server --resolver <address>")
+		fmt.Println("Usage: ./your_server --resolver <address> (or DNS_RESOLVER / DNS_UPSTREAM)")
+		os.Exit(1)
+	}
+
+	if ednsSize > 0 && (ednsSize < 512 || ednsSize > maxMessageSize) {
+		fmt.Println("EDNS payload size must be 0 or between 512 and 65535")
 		os.Exit(1)
 	}
 
-	// Resolve the DNS resolver address
-	resolverAddr, err := net.ResolveUDPAddr("udp", resolver)
+	privacy, err := parsePrivacy(logQNames)
 	if err != nil {
-		fmt.Printf("Failed to resolve resolver address: %v\n", err)
-		return
+		fmt.Println("Invalid --log-qnames:", err)
+		os.Exit(1)
+	}
+	logPrivacy = privacy
+
+	if trace && privacy != privacyFull {
+		fmt.Println("--trace logs whole messages and can't be combined with --log-qnames", logQNames)
+		os.Exit(1)
+	}
+	traceMessages = trace
+
+	overloadPolicy, err := parseOverloadPolicy(overload)
+	if err != nil {
+		fmt.Println("Invalid --overload:", err)
+		os.Exit(1)
+	}
+
+	startMode, err := parseServeMode(mode)
+	if err != nil {
+		fmt.Println("Invalid --mode:", err)
+		os.Exit(1)
+	}
+
+	// Build the query type filtering policy
+	policy := &QTypePolicy{}
+	if err := policy.addRules(refuseQTypes, qtypeRefuse); err != nil {
+		fmt.Println("Invalid --refuse-qtype:", err)
+		os.Exit(1)
+	}
+	if err := policy.addRules(nodataQTypes, qtypeNoData); err != nil {
+		fmt.Println("Invalid --nodata-qtype:", err)
+		os.Exit(1)
+	}
+
+	if localTTL > math.MaxInt32 {
+		fmt.Println("Local TTL must be at most", math.MaxInt32)
+		os.Exit(1)
+	}
+
+	records, err := LoadLocalRecords(recordsFile, uint32(localTTL))
+	if err != nil {
+		fmt.Println("Invalid --records:", err)
+		os.Exit(1)
+	}
+
+	options := NewEDNSOptionPolicy()
+	if err := options.addRules(ednsOptions); err != nil {
+		fmt.Println("Invalid --edns-option:", err)
+		os.Exit(1)
+	}
+
+	trustedMACSources, err := parseNetworks(macSources)
+	if err != nil {
+		fmt.Println("Invalid --mac-sources:", err)
+		os.Exit(1)
+	}
+
+	// Resolve the DNS resolver addresses
+	forwarder := &Forwarder{
+		EDNSSize:     uint16(ednsSize),
+		EDNSFallback: ednsFallback,
+		EDNSOptions:  options,
+	}
+	for _, address := range splitList(resolver) {
+		resolverAddr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			fmt.Printf("Failed to resolve resolver address: %v\n", err)
+			return
+		}
+		forwarder.Upstreams = append(forwarder.Upstreams, NewUpstream(resolverAddr))
+	}
+	if err := forwarder.addQTypeRoutes(qtypeResolvers); err != nil {
+		fmt.Println("Invalid --qtype-resolver:", err)
+		os.Exit(1)
+	}
+	if err := forwarder.addStubZones(stubZones); err != nil {
+		fmt.Println("Invalid --stub-zone:", err)
+		os.Exit(1)
+	}
+	if err := forwarder.addInsecureZones(insecureZones); err != nil {
+		fmt.Println("Invalid --insecure-zone:", err)
+		os.Exit(1)
+	}
+	for _, upstream := range forwarder.Upstreams {
+		upstream.limitOutstanding(int(upstreamInflight))
+	}
+	for _, upstreams := range forwarder.QTypeUpstreams {
+		for _, upstream := range upstreams {
+			upstream.limitOutstanding(int(upstreamInflight))
+		}
+	}
+	for _, upstreams := range forwarder.ZoneUpstreams {
+		for _, upstream := range upstreams {
+			upstream.limitOutstanding(int(upstreamInflight))
+		}
+	}
+
+	// Names on the command line may be Unicode, which queries carry as A-labels
+	ownNames, err := parseNames(splitList(selfNames))
+	if err != nil {
+		fmt.Println("Invalid --self-names:", err)
+		os.Exit(1)
+	}
+	ipNameZones, err := parseNames(splitList(ipZones))
+	if err != nil {
+		fmt.Println("Invalid --ip-names:", err)
+		os.Exit(1)
+	}
+	canaryNames, err := parseNames(splitList(canaries))
+	if err != nil {
+		fmt.Println("Invalid --canary:", err)
+		os.Exit(1)
+	}
+
+	server := &Server{
+		Forwarder:  forwarder,
+		Policy:     policy,
+		SelfNames:  NewSelfNames(ownNames, uint32(localTTL)),
+		Records:    records,
+		IPNames:    NewIPNames(ipNameZones, uint32(localTTL)),
+		MDNSBridge: mdnsBridge,
+		MaxTTL:     uint32(min(maxTTL, math.MaxInt32)),
+		DoHCanary:  dohCanary || policy.hasRules(),
+
+		IdentifyDevices: identifyDevices || policy.needsDevice(),
+		MACSources:      trustedMACSources,
+		Inflight:        NewInflightLimiter(int(maxInflight), overloadPolicy, overloadWait),
+	}
+	if maxStreamConns > 0 {
+		server.StreamConns = make(chan struct{}, maxStreamConns)
+	}
+
+	if mirror != "" {
+		if mirrorRate < 0 || mirrorRate > 1 {
+			fmt.Println("Mirror rate must be between 0 and 1")
+			os.Exit(1)
+		}
+		mirrorAddr, err := net.ResolveUDPAddr("udp", mirror)
+		if err != nil {
+			fmt.Println("Invalid --mirror:", err)
+			os.Exit(1)
+		}
+		server.Mirror = NewMirror(mirrorAddr, mirrorRate, mirrorCompare)
+	}
+
+	server.SetMode(startMode)
+
+	// Optionally verify the resolution path before reporting ready
+	if len(canaryNames) > 0 {
+		if err := runSelfTest(canaryNames, forwarder.Upstreams); err != nil {
+			fmt.Println("Startup self-test failed:", err)
+			os.Exit(1)
+		}
 	}
 
 	// Start the DNS server
-	address := "127.0.0.1:2053"
 	network := "udp"
-	udpAddr, err := net.ResolveUDPAddr(network, address)
+	udpAddr, err := net.ResolveUDPAddr(network, listen)
 	if err != nil {
 		fmt.Println("Failed to resolve UDP address:", err)
 		return
 	}
 	fmt.Printf("Running on PORT %d\n", udpAddr.Port)
+	if len(plugins) > 0 {
+		fmt.Println("Plugins:", strings.Join(pluginNames(), ", "))
+	}
 
-	udpConn, err := net.ListenUDP(network, udpAddr)
+	udpConn, err := listenUDPOrInherit(udpAddr)
 	if err != nil {
 		fmt.Println("Failed to bind to address:", err)
 		return
 	}
 	defer udpConn.Close()
 
-	buf := make([]byte, 512)
+	// Reply from the address each query was sent to, which a wildcard bind doesn't guarantee
+	if udpAddr.IP == nil || udpAddr.IP.IsUnspecified() {
+		if err := enablePktinfo(udpConn); err != nil {
+			fmt.Println("Replies may leave from another local address:", err)
+		}
+	}
+
+	// Serve TCP on the same address, for clients retrying truncated answers (RFC 7766)
+	var tcpListener net.Listener
+	if serveTCP {
+		local := udpConn.LocalAddr().(*net.UDPAddr) // has the port picked for port 0
+		tcpListener, err = listenTCPOrInherit(&net.TCPAddr{IP: local.IP, Port: local.Port, Zone: local.Zone})
+		if err != nil {
+			fmt.Println("Failed to listen on TCP:", err)
+			return
+		}
+		defer tcpListener.Close()
 
-	for {
-		size, source, err := udpConn.ReadFromUDP(buf)
+		go server.serveStream(tcpListener, TransportTCP)
+	}
+
+	var unixListener net.Listener
+	if listenUnixPath != "" {
+		unixListener, err = listenUnixOrInherit(listenUnixPath)
 		if err != nil {
-			fmt.Println("Error receiving data:", err)
-			break
+			fmt.Println("Failed to listen on Unix socket:", err)
+			return
 		}
+		defer unixListener.Close()
+		fmt.Printf("Running on %s\n", listenUnixPath)
 
-		handleQuery(buf[:size], resolverAddr, udpConn, source)
+		go server.serveStream(unixListener, TransportUnix)
 	}
+	go server.watchUpgrade(udpConn, tcpListener, unixListener)
+
+	server.serveUDP(udpConn)
 }
 
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// mdnsTimeout is how long we wait for any device on the LAN to answer an mDNS query.
+// A variable rather than a constant so tests can shorten it.
+var mdnsTimeout = 1 * time.Second
+
+// mdnsGroup is the IPv4 multicast address and port mDNS responders listen on (RFC 6762).
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// isMDNSName reports whether a name belongs to the link-local .local domain.
+func isMDNSName(name string) bool {
+	name = canonicalName(name)
+	return name == "local" || strings.HasSuffix(name, ".local")
+}
+
+// queryMDNS asks the LAN about a question with multicast DNS and returns the matching
+// answer records of the first reply that has any, rewritten so they can go in a
+// unicast response. Replies about the name without records of the type, such as the
+// NSEC record responders send for the types they don't have (RFC 6762 section 6.1),
+// give no records and no error once mdnsTimeout is over: the name exists without
+// data of the type. No reply about the name at all is an error.
+func queryMDNS(question DNSQuestion) ([]ResourceRecord, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(mdnsTimeout)); err != nil {
+		return nil, fmt.Errorf("failed to set mDNS deadline: %v", err)
+	}
+
+	header := DNSHeader{QDCOUNT: 1} // mDNS queries use ID 0 and no flags
+	query := header.toBytes()
+	query = append(query, encodeDomainName(question.Name)...)
+	query = binary.BigEndian.AppendUint16(query, uint16(question.Type))
+	query = append(query, 0x80, 0x01) // CLASS IN with the QU bit, asking for a unicast reply
+
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	buf := make([]byte, maxMessageSize)
+	named := false // a reply had records of the name, if none of the type
+	for {
+		size, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if named && errors.Is(err, os.ErrDeadlineExceeded) {
+				return []ResourceRecord{}, nil
+			}
+			return nil, fmt.Errorf("no mDNS answer: %v", err)
+		}
+
+		records, ok := mdnsAnswers(buf[:size], question)
+		if len(records) > 0 {
+			return records, nil
+		}
+		named = named || ok
+	}
+}
+
+// mdnsAnswers returns the answer records of an mDNS response that answer the question:
+// owned by its name and of its type, or a CNAME, or of any type for ANY. Responders
+// may send other records of the name along, which aren't what was asked. The mDNS
+// cache-flush bit is cleared from the class. The boolean reports whether the response
+// has any record of the name, in any section.
+func mdnsAnswers(response []byte, question DNSQuestion) ([]ResourceRecord, bool) {
+	var msg DNSMessage
+	if err := msg.Unmarshal(response); err != nil || msg.Header.QR == 0 { // malformed or not a response
+		return nil, false
+	}
+
+	named := false
+	for _, section := range [][]ResourceRecord{msg.Answers, msg.Authority, msg.Additionals} {
+		for _, record := range section {
+			named = named || canonicalName(record.Name) == canonicalName(question.Name)
+		}
+	}
+
+	records := []ResourceRecord{}
+	for _, answer := range msg.Answers {
+		if canonicalName(answer.Name) != canonicalName(question.Name) {
+			continue
+		}
+		if answer.Type != question.Type && answer.Type != typeCNAME && question.Type != typeANY {
+			continue
+		}
+
+		answer.Class &^= 0x8000
+		records = append(records, answer)
+	}
+
+	return records, named
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMDNSBridge checks the answers the bridge gives for what the LAN replies to a
+// query for printer.local A, with a fake responder in place of the multicast group.
+func TestMDNSBridge(t *testing.T) {
+	const name = "printer.local"
+	a := ResourceRecord{Name: name, Type: typeA, Class: classIN, TTL: 120, Data: AData{IP: net.IPv4(192, 168, 1, 20).To4()}}
+	aaaa := ResourceRecord{Name: name, Type: typeAAAA, Class: classIN, TTL: 120, Data: AAAAData{IP: net.ParseIP("fd00::20")}}
+	// NSEC with the name itself as the next name and AAAA as its only type
+	nsec := ResourceRecord{Name: name, Type: 47, Class: classIN, TTL: 120, Data: UnknownData("\x07printer\x05local\x00\x00\x04\x00\x00\x00\x08")}
+
+	tests := []struct {
+		name       string
+		records    string       // local records file
+		replies    []DNSMessage // sent back to the query
+		wantRCode  RCode
+		wantAnswer []string
+	}{
+		{name: "answered", replies: []DNSMessage{{Header: DNSHeader{QR: 1, AA: 1}, Answers: []ResourceRecord{a, aaaa}}},
+			wantAnswer: []string{"printer.local. 120 IN A 192.168.1.20"}},
+		{name: "cache-flush bit cleared", replies: []DNSMessage{{Header: DNSHeader{QR: 1, AA: 1}, Answers: []ResourceRecord{
+			{Name: name, Type: typeA, Class: classIN | 0x8000, TTL: 120, Data: a.Data}}}},
+			wantAnswer: []string{"printer.local. 120 IN A 192.168.1.20"}},
+		{name: "answered after another name", replies: []DNSMessage{
+			{Header: DNSHeader{QR: 1, AA: 1}, Answers: []ResourceRecord{{Name: "scanner.local", Type: typeA, Class: classIN, TTL: 120, Data: a.Data}}},
+			{Header: DNSHeader{QR: 1, AA: 1}, Answers: []ResourceRecord{a}}},
+			wantAnswer: []string{"printer.local. 120 IN A 192.168.1.20"}},
+		{name: "only another type", replies: []DNSMessage{{Header: DNSHeader{QR: 1, AA: 1}, Answers: []ResourceRecord{aaaa}}}},
+		{name: "NSEC for the missing type", replies: []DNSMessage{{Header: DNSHeader{QR: 1, AA: 1}, Additionals: []ResourceRecord{nsec}}}},
+		{name: "only another name", replies: []DNSMessage{{Header: DNSHeader{QR: 1, AA: 1}, Answers: []ResourceRecord{
+			{Name: "scanner.local", Type: typeA, Class: classIN, TTL: 120, Data: a.Data}}}}, wantRCode: rcodeServFail},
+		{name: "not a response", replies: []DNSMessage{{Answers: []ResourceRecord{a}}}, wantRCode: rcodeServFail},
+		{name: "no reply", wantRCode: rcodeServFail},
+		{name: "no reply in a local zone", records: "local SOA ns.lan admin.lan 1 3600 600 86400 300\n", wantRCode: rcodeNXDomain},
+	}
+
+	oldGroup, oldTimeout := mdnsGroup, mdnsTimeout
+	t.Cleanup(func() { mdnsGroup, mdnsTimeout = oldGroup, oldTimeout })
+	mdnsTimeout = 100 * time.Millisecond
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mdnsGroup = startUDPUpstream(t, func([]byte) (time.Duration, [][]byte) {
+				replies := [][]byte{}
+				for _, reply := range tt.replies {
+					wire, err := reply.Marshal()
+					if err != nil {
+						t.Error(err)
+					}
+					replies = append(replies, wire)
+				}
+				return 0, replies
+			})
+			server := newLocalServer(t, tt.records)
+			server.MDNSBridge = true
+
+			query, err := (&DNSMessage{Header: DNSHeader{ID: 1, RD: 1}, Questions: []DNSQuestion{{Name: name, Type: typeA, Class: classIN}}}).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var msg DNSMessage
+			if err := msg.Unmarshal(handle(server, query)); err != nil {
+				t.Fatalf("response doesn't parse: %v", err)
+			}
+			if msg.Header.RCODE != tt.wantRCode {
+				t.Errorf("got %s, want %s", msg.Header.RCODE, tt.wantRCode)
+			}
+			if got, want := strings.Join(recordLines(msg.Answers), "\n"), strings.Join(tt.wantAnswer, "\n"); got != want {
+				t.Errorf("got answer:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// mirrorMaxInflight caps the copies waiting for the mirror's answer, so a slow mirror
+// can't pile up goroutines. Queries beyond it simply aren't mirrored.
+const mirrorMaxInflight = 64
+
+// Mirror copies a sample of the queries forwarded to the resolvers to another resolver,
+// for migration testing or analytics. It runs in the background and never delays or
+// changes what clients get. In compare mode the mirror's answers are checked against
+// the resolvers' and differences are logged; otherwise they are read and discarded.
+// A nil Mirror copies nothing.
+type Mirror struct {
+	Addr *net.UDPAddr
+
+	rate    float64       // fraction of queries copied, between 0 and 1
+	compare bool          // log where the mirror's answers differ from the resolvers'
+	slots   chan struct{} // one per copy in flight
+
+	failed   atomic.Uint64 // copies that got no answer, for the failure log
+	compared atomic.Uint64 // answers compared in compare mode
+	differed atomic.Uint64 // compared answers that differed
+}
+
+// NewMirror creates a mirror copying the given fraction of queries to addr.
+func NewMirror(addr *net.UDPAddr, rate float64, compare bool) *Mirror {
+	return &Mirror{Addr: addr, rate: rate, compare: compare, slots: make(chan struct{}, mirrorMaxInflight)}
+}
+
+// copy sends a copy of the query to the mirror if it is sampled and a slot is free.
+// It is called once the resolvers have answered with response, nil if they failed,
+// which the mirror's answer is compared with in compare mode.
+func (m *Mirror) copy(query []byte, response []byte) {
+	if m == nil || rand.Float64() >= m.rate {
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		return
+	}
+
+	query = append([]byte{}, query...)
+	if response != nil {
+		response = append([]byte{}, response...) // the caller goes on to change it in place
+	}
+	go func() {
+		defer func() { <-m.slots }()
+
+		shadow, _, err := forwardDNSQuery(query, m.Addr, upstreamTimeout, upstreamTimeout)
+		if err != nil {
+			// Log the first failure and then every 1000, not every one
+			if failed := m.failed.Add(1); failed%1000 == 1 {
+				fmt.Printf("Mirror %s: %v (%d failures so far)\n", m.Addr, err, failed)
+			}
+			return
+		}
+		if m.compare && response != nil {
+			m.compareAnswers(query, response, shadow)
+		}
+	}()
+}
+
+// compareAnswers logs how the mirror's answer to a query differs from the resolvers'
+// in RCODE or answer records. TTLs and the order of records are not compared.
+func (m *Mirror) compareAnswers(query []byte, primary []byte, shadow []byte) {
+	if validateMessage(primary) != nil || validateMessage(shadow) != nil {
+		return
+	}
+	compared := m.compared.Add(1)
+
+	differences := []string{}
+	if rcode, shadowRCode := messageRCode(primary), messageRCode(shadow); rcode != shadowRCode {
+		differences = append(differences, fmt.Sprintf("RCODE %s, mirror %s", rcode, shadowRCode))
+	}
+	records, shadowRecords := answerSet(primary), answerSet(shadow)
+	if only := missingFrom(shadowRecords, records); len(only) > 0 {
+		differences = append(differences, "only from the resolvers: "+strings.Join(only, "; "))
+	}
+	if only := missingFrom(records, shadowRecords); len(only) > 0 {
+		differences = append(differences, "only from the mirror: "+strings.Join(only, "; "))
+	}
+	if len(differences) == 0 {
+		return
+	}
+
+	question := "the query"
+	if questions, _, err := parseQuestions(query, 12, int(binary.BigEndian.Uint16(query[4:6]))); err == nil && len(questions) > 0 {
+		question = fmt.Sprintf("%s %s", logName(questions[0].Name), questions[0].Type)
+	}
+	fmt.Printf("Mirror %s differs for %s: %s (%d of %d compared answers differ)\n",
+		m.Addr, question, strings.Join(differences, ", "), m.differed.Add(1), compared)
+}
+
+// answerSet renders the answer records of a valid message for comparison, without TTLs,
+// each mapped to how it may be logged: the owner through logName and the RDATA through
+// logRDATA.
+func answerSet(msg []byte) map[string]string {
+	_, offset, _ := parseQuestions(msg, 12, int(binary.BigEndian.Uint16(msg[4:6])))
+
+	records := map[string]string{}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:8])); i++ {
+		name, typeOffset, _ := parseDomainName(msg, offset)
+		offset, _ = skipRecord(msg, offset)
+
+		rtype := QType(binary.BigEndian.Uint16(msg[typeOffset : typeOffset+2]))
+		class := QClass(binary.BigEndian.Uint16(msg[typeOffset+2 : typeOffset+4]))
+		rdata := formatRDATA(msg, rtype, typeOffset+10, offset)
+		owner := foldCase(fqdn(name))
+		records[fmt.Sprintf("%s %s %s %s", owner, class, rtype, rdata)] = fmt.Sprintf("%s %s %s %s", logName(owner), class, rtype, logRDATA(rdata))
+	}
+
+	return records
+}
+
+// missingFrom returns how the records of want that aren't in have are logged, sorted.
+func missingFrom(have map[string]string, want map[string]string) []string {
+	missing := []string{}
+	for record, logged := range want {
+		if _, ok := have[record]; !ok {
+			missing = append(missing, logged)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
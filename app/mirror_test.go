@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAnswerSetLogging(t *testing.T) {
+	msg := DNSMessage{
+		Header:    DNSHeader{ID: 1, QR: 1},
+		Questions: []DNSQuestion{{Name: "www.example.com", Type: typeA, Class: classIN}},
+		Answers: []ResourceRecord{
+			{Name: "www.example.com", Type: typeCNAME, Class: classIN, TTL: 60, Data: CNAMEData{Target: "web.example.com"}},
+			{Name: "web.example.com", Type: typeA, Class: classIN, TTL: 60, Data: AData{IP: net.IPv4(192, 0, 2, 1).To4()}},
+		},
+	}
+	response, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		privacy qnamePrivacy
+		want    []string
+	}{
+		{privacy: privacyFull, want: []string{"web.example.com. IN A 192.0.2.1", "www.example.com. IN CNAME web.example.com."}},
+		{privacy: privacyDomain, want: []string{"example.com IN A <redacted>", "example.com IN CNAME <redacted>"}},
+		{privacy: privacyNone, want: []string{"<redacted> IN A <redacted>", "<redacted> IN CNAME <redacted>"}},
+	}
+
+	defer func() { logPrivacy = privacyFull }()
+	for _, tt := range tests {
+		logPrivacy = tt.privacy
+		got := missingFrom(nil, answerSet(response))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("privacy %d: got %q, want %q", tt.privacy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// serveMode restricts what the server answers, for operating it through upstream
+// outages and maintenance windows.
+type serveMode int32
+
+const (
+	modeNormal      serveMode = iota // answer from local data and the resolvers
+	modeLocalOnly                    // answer from local data only, refusing what would be forwarded
+	modeMaintenance                  // answer everything with SERVFAIL
+)
+
+// serveModeNames maps the --mode flag values to modes.
+var serveModeNames = map[string]serveMode{
+	"normal":      modeNormal,
+	"local-only":  modeLocalOnly,
+	"maintenance": modeMaintenance,
+}
+
+// ednsOptionEDE is the Extended DNS Error option code (RFC 8914).
+const ednsOptionEDE = 15
+
+// Extended DNS Error info codes used in the answers of the restricted modes.
+const (
+	edeOther            uint16 = 0
+	edeNotAuthoritative uint16 = 20
+)
+
+// parseServeMode converts the --mode flag value into a mode.
+func parseServeMode(name string) (serveMode, error) {
+	if mode, ok := serveModeNames[name]; ok {
+		return mode, nil
+	}
+
+	return modeNormal, fmt.Errorf("unknown mode %q, expected normal, local-only or maintenance", name)
+}
+
+func (m serveMode) String() string {
+	for name, mode := range serveModeNames {
+		if mode == m {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("mode%d", int32(m))
+}
+
+// SetMode switches the server to another mode, taking effect with the next query.
+func (s *Server) SetMode(mode serveMode) {
+	if previous := serveMode(s.mode.Swap(int32(mode))); previous != mode {
+		fmt.Printf("Switched from %s to %s mode\n", previous, mode)
+	}
+}
+
+// currentMode returns the mode queries are answered in.
+func (s *Server) currentMode() serveMode {
+	return serveMode(s.mode.Load())
+}
+
+// withEDE adds an OPT record carrying an Extended DNS Error to a response, if the
+// query had one; clients that don't speak EDNS must not get an OPT record.
+func withEDE(response []byte, query []byte, offset int, code uint16, text string) []byte {
+	start, _ := findOPT(query, offset)
+	if start < 0 {
+		return response
+	}
+	_, typeOffset, _ := parseDomainName(query, start) // findOPT only returns complete records
+
+	data := append(binary.BigEndian.AppendUint16(nil, code), text...)
+	return appendOPT(response, EDNS{
+		DO:      query[typeOffset+6]&0x80 != 0, // echoed as RFC 3225 requires
+		Options: []EDNSOption{{Code: ednsOptionEDE, Data: data}},
+	})
+}
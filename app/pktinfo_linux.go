@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// pktinfoBufferSize is room for the one control message each datagram comes with.
+var pktinfoBufferSize = syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+// enablePktinfo asks the kernel to report the local address every datagram on conn
+// arrived on, for sockets bound to the unspecified address. A dual-stack socket
+// reports IPv4 datagrams through the IPv6 option, so both are tried.
+func enablePktinfo(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var v4Err, v6Err error
+	if err := raw.Control(func(fd uintptr) {
+		v4Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		v6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	}); err != nil {
+		return err
+	}
+	if v4Err != nil && v6Err != nil {
+		return fmt.Errorf("failed to enable IP_PKTINFO: %v", v4Err)
+	}
+
+	return nil
+}
+
+// replySource returns the control message that makes a reply leave from the local
+// address a datagram with control messages oob arrived on, or nil if oob doesn't
+// give it. The arrival interface is only kept for IPv6, where link-local addresses
+// need it; IPv4 replies are routed as usual.
+func replySource(oob []byte) []byte {
+	reply := append([]byte{}, oob...)
+	messages, err := syscall.ParseSocketControlMessage(reply)
+	if err != nil || len(messages) != 1 {
+		return nil
+	}
+
+	switch message := messages[0]; {
+	case message.Header.Level == syscall.IPPROTO_IP && message.Header.Type == syscall.IP_PKTINFO &&
+		len(message.Data) >= syscall.SizeofInet4Pktinfo:
+		copy(message.Data[0:4], []byte{0, 0, 0, 0}) // Ifindex, the local address is in Spec_dst
+		return reply
+	case message.Header.Level == syscall.IPPROTO_IPV6 && message.Header.Type == syscall.IPV6_PKTINFO &&
+		len(message.Data) >= syscall.SizeofInet6Pktinfo:
+		return reply
+	}
+
+	return nil
+}
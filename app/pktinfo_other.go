@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// pktinfoBufferSize is 0 where local addresses of datagrams aren't reported.
+var pktinfoBufferSize = 0
+
+// enablePktinfo is only implemented on Linux.
+func enablePktinfo(conn *net.UDPConn) error {
+	return fmt.Errorf("reply source pinning is only supported on Linux")
+}
+
+// replySource never has a local address to pin outside Linux.
+func replySource(oob []byte) []byte {
+	return nil
+}
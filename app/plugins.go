@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Plugin is custom code built into the server that sees queries and responses as they
+// pass through. A plugin lives in its own file in this package and registers itself
+// from an init function, so integrations don't need changes to the server itself:
+//
+//	func init() {
+//		RegisterPlugin(Plugin{Name: "audit", OnResponse: auditResponse})
+//	}
+type Plugin struct {
+	Name string
+
+	// OnQuery is called for each well-formed query before the server answers it, and
+	// may change it. Returning a response answers the query with it instead; returning
+	// nil lets the next plugin and then the server handle the query.
+	OnQuery func(req *RequestContext, query *DNSMessage) *DNSMessage
+
+	// OnResponse is called for each response just before it is sent, and may change
+	// it. The result is still truncated to req.MaxResponseSize afterwards.
+	OnResponse func(req *RequestContext, response *DNSMessage)
+}
+
+var (
+	pluginsMu sync.Mutex
+	plugins   []Plugin // in registration order, which is the order they are called in
+)
+
+// RegisterPlugin adds a plugin to the server. It must be called before the server
+// starts, normally from an init function.
+func RegisterPlugin(plugin Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	for _, registered := range plugins {
+		if registered.Name == plugin.Name {
+			panic(fmt.Sprintf("plugin %q registered twice", plugin.Name))
+		}
+	}
+	plugins = append(plugins, plugin)
+}
+
+// pluginNames returns the names of the registered plugins, for the startup log.
+func pluginNames() []string {
+	names := []string{}
+	for _, plugin := range plugins {
+		names = append(names, plugin.Name)
+	}
+
+	return names
+}
+
+// callPlugin runs one hook of a plugin, turning a panic into an error so a faulty
+// plugin fails the one query rather than the whole server.
+func callPlugin(plugin Plugin, hook func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("plugin %s failed: %v", plugin.Name, r)
+		}
+	}()
+	hook()
+
+	return nil
+}
+
+// runQueryPlugins passes a query through the OnQuery hooks. It returns the query as
+// the plugins left it, re-encoded if any plugin could have changed it, and the
+// response of the first plugin that answered it, if any.
+func runQueryPlugins(req *RequestContext, query []byte, message *DNSMessage) ([]byte, []byte, error) {
+	called := false
+	for _, plugin := range plugins {
+		if plugin.OnQuery == nil {
+			continue
+		}
+		called = true
+
+		var answer *DNSMessage
+		if err := callPlugin(plugin, func() { answer = plugin.OnQuery(req, message) }); err != nil {
+			return nil, nil, err
+		}
+		if answer != nil {
+			response, err := answer.Marshal()
+			if err != nil {
+				return nil, nil, fmt.Errorf("plugin %s answered with an invalid response: %v", plugin.Name, err)
+			}
+			return query, response, nil
+		}
+	}
+	if !called {
+		return query, nil, nil
+	}
+
+	changed, err := message.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("plugins left an invalid query: %v", err)
+	}
+
+	return changed, nil, nil
+}
+
+// runResponsePlugins passes a response through the OnResponse hooks and returns it re-encoded.
+func runResponsePlugins(req *RequestContext, response []byte) ([]byte, error) {
+	var message *DNSMessage
+	for _, plugin := range plugins {
+		if plugin.OnResponse == nil {
+			continue
+		}
+		if message == nil {
+			message = &DNSMessage{}
+			if err := message.Unmarshal(response); err != nil {
+				return nil, fmt.Errorf("can't decode the response for plugins: %v", err)
+			}
+		}
+
+		if err := callPlugin(plugin, func() { plugin.OnResponse(req, message) }); err != nil {
+			return nil, err
+		}
+	}
+	if message == nil {
+		return response, nil
+	}
+
+	return message.Marshal()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// qnamePrivacy controls how much of a client's query name is written to logs.
+type qnamePrivacy int
+
+const (
+	privacyFull   qnamePrivacy = iota // log the full query name
+	privacyDomain                     // log only the registered domain, e.g. example.com for www.example.com
+	privacyNone                       // never log query names
+)
+
+// logPrivacy is the privacy level applied by logName, set once from the command line.
+var logPrivacy = privacyFull
+
+// parsePrivacy converts the --log-qnames flag value into a privacy level.
+func parsePrivacy(level string) (qnamePrivacy, error) {
+	switch level {
+	case "full":
+		return privacyFull, nil
+	case "domain":
+		return privacyDomain, nil
+	case "none":
+		return privacyNone, nil
+	}
+
+	return privacyFull, fmt.Errorf("unknown privacy level %q, expected full, domain or none", level)
+}
+
+// logName returns a client's query name as it may appear in logs under the configured
+// privacy level, with A-labels shown in Unicode. The registered domain is approximated
+// as the last two labels, since the server has no public suffix list.
+func logName(name string) string {
+	name = toUnicode(name)
+	switch logPrivacy {
+	case privacyNone:
+		return "<redacted>"
+	case privacyDomain:
+		labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+		if len(labels) > 2 {
+			return strings.Join(labels[len(labels)-2:], ".")
+		}
+	}
+
+	return name
+}
+
+// logRDATA returns the presentation form of a record's RDATA as it may appear in logs.
+// RDATA holds names and addresses that tell as much about a query as its name, so it
+// is only logged in full when query names are.
+func logRDATA(rdata string) string {
+	if logPrivacy != privacyFull {
+		return "<redacted>"
+	}
+
+	return rdata
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// qtypeAction is what the server does with a query whose QTYPE matches a policy rule.
+type qtypeAction int
+
+const (
+	qtypeAllow  qtypeAction = iota // forward as usual
+	qtypeNoData                    // answer NOERROR with an empty answer section
+	qtypeRefuse                    // answer REFUSED
+)
+
+// qtypeNames maps the type mnemonics accepted in policy flags and the records file to their codes.
+var qtypeNames = map[string]QType{
+	"A":     typeA,
+	"NS":    typeNS,
+	"CNAME": typeCNAME,
+	"SOA":   typeSOA,
+	"PTR":   typePTR,
+	"MX":    typeMX,
+	"TXT":   typeTXT,
+	"AAAA":  typeAAAA,
+	"SRV":   typeSRV,
+	"SVCB":  typeSVCB,
+	"HTTPS": typeHTTPS,
+	"ANY":   typeANY,
+}
+
+// qtypeRule applies an action to one QTYPE, optionally only for clients in a network
+// or for a single device identified by its MAC address.
+type qtypeRule struct {
+	qtype   QType
+	network *net.IPNet // nil matches every client
+	device  string     // MAC address, "" matches every device
+	action  qtypeAction
+}
+
+// QTypePolicy lets administrators refuse or force NODATA for specific QTYPEs,
+// either for every client or only for clients within a network or a given device.
+type QTypePolicy struct {
+	rules []qtypeRule
+}
+
+// parseQType converts a type mnemonic (e.g. "AAAA") or generic "TYPEnnn" into its code.
+func parseQType(name string) (QType, error) {
+	name = strings.ToUpper(name)
+	if qtype, ok := qtypeNames[name]; ok {
+		return qtype, nil
+	}
+
+	if strings.HasPrefix(name, "TYPE") {
+		qtype, err := strconv.ParseUint(name[4:], 10, 16)
+		if err == nil {
+			return QType(qtype), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown query type %q", name)
+}
+
+// addRules parses a comma-separated list of TYPE, TYPE@CIDR or TYPE@MAC entries and
+// adds a rule with the given action for each of them.
+func (p *QTypePolicy) addRules(list string, action qtypeAction) error {
+	for _, entry := range splitList(list) {
+		name, cidr, scoped := strings.Cut(entry, "@")
+
+		qtype, err := parseQType(name)
+		if err != nil {
+			return err
+		}
+
+		rule := qtypeRule{qtype: qtype, action: action}
+		if scoped {
+			if mac, err := net.ParseMAC(cidr); err == nil {
+				rule.device = mac.String()
+			} else if _, network, err := net.ParseCIDR(cidr); err == nil {
+				rule.network = network
+			} else {
+				return fmt.Errorf("invalid client network or MAC address in %q: %v", entry, err)
+			}
+		}
+
+		p.rules = append(p.rules, rule)
+	}
+
+	return nil
+}
+
+// hasRules reports whether the policy filters anything at all.
+func (p *QTypePolicy) hasRules() bool {
+	return len(p.rules) > 0
+}
+
+// needsDevice reports whether any rule is scoped to a device, so queries must be identified.
+func (p *QTypePolicy) needsDevice() bool {
+	for _, rule := range p.rules {
+		if rule.device != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// action returns the strictest action any rule applies to the questions from the client.
+func (p *QTypePolicy) action(req *RequestContext, questions []DNSQuestion) qtypeAction {
+	client := req.clientIP()
+	result := qtypeAllow
+	for _, question := range questions {
+		for _, rule := range p.rules {
+			if rule.qtype != question.Type || (rule.network != nil && !rule.network.Contains(client)) {
+				continue
+			}
+			if rule.device != "" && rule.device != req.DeviceID {
+				continue
+			}
+			if rule.action > result {
+				result = rule.action
+			}
+		}
+	}
+
+	return result
+}
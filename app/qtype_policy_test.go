@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestQTypePolicyAction(t *testing.T) {
+	const device = "02:00:00:00:00:01"
+
+	tests := []struct {
+		name      string
+		refuse    string
+		nodata    string
+		client    string
+		device    string
+		questions []QType
+		want      qtypeAction
+	}{
+		{name: "no rules", client: "10.0.0.1", questions: []QType{typeANY}, want: qtypeAllow},
+		{name: "other type", refuse: "ANY", client: "10.0.0.1", questions: []QType{typeA}, want: qtypeAllow},
+		{name: "refused", refuse: "ANY", client: "10.0.0.1", questions: []QType{typeANY}, want: qtypeRefuse},
+		{name: "NODATA", nodata: "AAAA", client: "10.0.0.1", questions: []QType{typeAAAA}, want: qtypeNoData},
+		{name: "generic type name", nodata: "TYPE65", client: "10.0.0.1", questions: []QType{typeHTTPS}, want: qtypeNoData},
+		{name: "client in the network", refuse: "ANY@10.0.0.0/8", client: "10.1.2.3", questions: []QType{typeANY}, want: qtypeRefuse},
+		{name: "client outside the network", refuse: "ANY@10.0.0.0/8", client: "192.168.1.2", questions: []QType{typeANY}, want: qtypeAllow},
+		{name: "IPv6 network", nodata: "A@fd00::/8", client: "fd00::1", questions: []QType{typeA}, want: qtypeNoData},
+		// The strictest matching rule wins, however narrow the others are
+		{name: "narrower refuse over NODATA", refuse: "AAAA@10.0.0.0/24", nodata: "AAAA", client: "10.0.0.5", questions: []QType{typeAAAA}, want: qtypeRefuse},
+		{name: "outside the narrower refuse", refuse: "AAAA@10.0.0.0/24", nodata: "AAAA", client: "10.0.1.5", questions: []QType{typeAAAA}, want: qtypeNoData},
+		{name: "broader refuse over narrower NODATA", refuse: "AAAA@10.0.0.0/8", nodata: "AAAA@10.0.0.0/24", client: "10.0.0.5", questions: []QType{typeAAAA}, want: qtypeRefuse},
+		{name: "device", refuse: "TXT@" + device, client: "10.0.0.1", device: device, questions: []QType{typeTXT}, want: qtypeRefuse},
+		{name: "other device", refuse: "TXT@" + device, client: "10.0.0.1", device: "02:00:00:00:00:02", questions: []QType{typeTXT}, want: qtypeAllow},
+		{name: "unidentified device", refuse: "TXT@" + device, client: "10.0.0.1", questions: []QType{typeTXT}, want: qtypeAllow},
+		{name: "strictest over several questions", refuse: "ANY", nodata: "AAAA", client: "10.0.0.1", questions: []QType{typeA, typeAAAA, typeANY}, want: qtypeRefuse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &QTypePolicy{}
+			if err := policy.addRules(tt.refuse, qtypeRefuse); err != nil {
+				t.Fatal(err)
+			}
+			if err := policy.addRules(tt.nodata, qtypeNoData); err != nil {
+				t.Fatal(err)
+			}
+
+			req := &RequestContext{ClientAddr: &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 5353}, DeviceID: tt.device}
+			questions := []DNSQuestion{}
+			for _, qtype := range tt.questions {
+				questions = append(questions, DNSQuestion{Name: "example.com", Type: qtype, Class: classIN})
+			}
+			if got := policy.action(req, questions); got != tt.want {
+				t.Errorf("got action %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQTypePolicyAddRulesInvalid(t *testing.T) {
+	for _, list := range []string{
+		"BOGUS",
+		"TYPE70000",
+		"AAAA@10.0.0.0/33",
+		"AAAA@nas.lan",
+		"AAAA,BOGUS@10.0.0.0/8",
+	} {
+		if err := (&QTypePolicy{}).addRules(list, qtypeRefuse); err == nil {
+			t.Errorf("parsed %q, want an error", list)
+		}
+	}
+}
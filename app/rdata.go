@@ -0,0 +1,619 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// RDATA is the type-specific data of a resource record. Each record type the codec
+// understands has its own implementation and a decoder in rdataDecoders; records of
+// other types keep their RDATA as UnknownData.
+type RDATA interface {
+	// encode appends the RDATA in wire format to msg. Names go through names, if
+	// the type allows compressing them, so they can point into the rest of msg.
+	encode(msg []byte, names *compressor) ([]byte, error)
+
+	// String returns the RDATA in presentation format, as dig and zone files show it.
+	String() string
+}
+
+// rdataDecoder decodes the RDATA between start and end of msg. It gets the whole
+// message so compressed names inside the RDATA can be followed.
+type rdataDecoder func(msg []byte, start int, end int) (RDATA, error)
+
+// rdataDecoders holds the decoder of every record type with its own RDATA implementation.
+var rdataDecoders = map[QType]rdataDecoder{
+	typeA:     decodeA,
+	typeNS:    decodeNS,
+	typeCNAME: decodeCNAME,
+	typeSOA:   decodeSOA,
+	typePTR:   decodePTR,
+	typeMX:    decodeMX,
+	typeTXT:   decodeTXT,
+	typeAAAA:  decodeAAAA,
+	typeSRV:   decodeSRV,
+	typeOPT:   decodeOPT,
+	typeSVCB:  decodeSVCB,
+	typeHTTPS: decodeSVCB,
+}
+
+// rdataParser parses the presentation form of an RDATA, split into fields, as written
+// in the local records file.
+type rdataParser func(fields []string) (RDATA, error)
+
+// rdataParsers holds the parser of every record type that can be defined locally.
+var rdataParsers = map[QType]rdataParser{
+	typeA:     parseAData,
+	typeNS:    parseNSData,
+	typeCNAME: parseCNAMEData,
+	typeSOA:   parseSOAData,
+	typePTR:   parsePTRData,
+	typeMX:    parseMXData,
+	typeTXT:   parseTXTData,
+	typeAAAA:  parseAAAAData,
+	typeSRV:   parseSRVData,
+	typeSVCB:  parseSVCBData,
+	typeHTTPS: parseSVCBData,
+}
+
+// decodeRDATA decodes the RDATA of a record of type rtype between start and end of msg.
+func decodeRDATA(msg []byte, rtype QType, start int, end int) (RDATA, error) {
+	if decode, ok := rdataDecoders[rtype]; ok {
+		return decode(msg, start, end)
+	}
+
+	data, err := expandRDATA(msg, rtype, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnknownData(data), nil
+}
+
+// AData is the RDATA of an A record: an IPv4 address.
+type AData struct {
+	IP net.IP
+}
+
+func decodeA(msg []byte, start int, end int) (RDATA, error) {
+	if end-start != net.IPv4len {
+		return nil, fmt.Errorf("address is %d bytes, expected %d", end-start, net.IPv4len)
+	}
+
+	return AData{IP: net.IP(append([]byte{}, msg[start:end]...))}, nil
+}
+
+func parseAData(fields []string) (RDATA, error) {
+	ip := net.ParseIP(fields[0])
+	if len(fields) != 1 || ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("expected an IPv4 address, got %q", strings.Join(fields, " "))
+	}
+
+	return AData{IP: ip.To4()}, nil
+}
+
+func (data AData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	ip := data.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("%v is not an IPv4 address", data.IP)
+	}
+
+	return append(buf, ip...), nil
+}
+
+func (data AData) String() string {
+	return data.IP.String()
+}
+
+// AAAAData is the RDATA of an AAAA record: an IPv6 address (RFC 3596).
+type AAAAData struct {
+	IP net.IP
+}
+
+func decodeAAAA(msg []byte, start int, end int) (RDATA, error) {
+	if end-start != net.IPv6len {
+		return nil, fmt.Errorf("address is %d bytes, expected %d", end-start, net.IPv6len)
+	}
+
+	return AAAAData{IP: net.IP(append([]byte{}, msg[start:end]...))}, nil
+}
+
+func parseAAAAData(fields []string) (RDATA, error) {
+	ip := net.ParseIP(fields[0])
+	if len(fields) != 1 || ip == nil || ip.To4() != nil {
+		return nil, fmt.Errorf("expected an IPv6 address, got %q", strings.Join(fields, " "))
+	}
+
+	return AAAAData{IP: ip}, nil
+}
+
+func (data AAAAData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	ip := data.IP.To16()
+	if ip == nil {
+		return nil, fmt.Errorf("%v is not an IP address", data.IP)
+	}
+
+	return append(buf, ip...), nil
+}
+
+func (data AAAAData) String() string {
+	return data.IP.String()
+}
+
+// NSData is the RDATA of an NS record: a nameserver authoritative for the owner's zone.
+type NSData struct {
+	Host string
+}
+
+func decodeNS(msg []byte, start int, end int) (RDATA, error) {
+	host, err := decodeNameRDATA(msg, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return NSData{Host: host}, nil
+}
+
+func parseNSData(fields []string) (RDATA, error) {
+	host, err := parseNameField(fields, "nameserver name")
+	if err != nil {
+		return nil, err
+	}
+
+	return NSData{Host: host}, nil
+}
+
+func (data NSData) encode(buf []byte, names *compressor) ([]byte, error) {
+	return names.appendName(buf, data.Host)
+}
+
+func (data NSData) String() string {
+	return fqdn(data.Host)
+}
+
+// CNAMEData is the RDATA of a CNAME record: the canonical name the owner is an alias for.
+type CNAMEData struct {
+	Target string
+}
+
+func decodeCNAME(msg []byte, start int, end int) (RDATA, error) {
+	target, err := decodeNameRDATA(msg, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return CNAMEData{Target: target}, nil
+}
+
+func parseCNAMEData(fields []string) (RDATA, error) {
+	target, err := parseNameField(fields, "target name")
+	if err != nil {
+		return nil, err
+	}
+
+	return CNAMEData{Target: target}, nil
+}
+
+func (data CNAMEData) encode(buf []byte, names *compressor) ([]byte, error) {
+	return names.appendName(buf, data.Target)
+}
+
+func (data CNAMEData) String() string {
+	return fqdn(data.Target)
+}
+
+// PTRData is the RDATA of a PTR record: the name its owner points to, typically the
+// host name for an in-addr.arpa or ip6.arpa address name.
+type PTRData struct {
+	Target string
+}
+
+func decodePTR(msg []byte, start int, end int) (RDATA, error) {
+	target, err := decodeNameRDATA(msg, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return PTRData{Target: target}, nil
+}
+
+func parsePTRData(fields []string) (RDATA, error) {
+	target, err := parseNameField(fields, "target name")
+	if err != nil {
+		return nil, err
+	}
+
+	return PTRData{Target: target}, nil
+}
+
+func (data PTRData) encode(buf []byte, names *compressor) ([]byte, error) {
+	return names.appendName(buf, data.Target)
+}
+
+func (data PTRData) String() string {
+	return fqdn(data.Target)
+}
+
+// SOAData is the RDATA of an SOA record, which starts a zone of authority: its primary
+// nameserver, the mailbox of its administrator written as a name, and the timers
+// secondaries use. Minimum also caps the TTL of negative answers (RFC 2308 section 4).
+type SOAData struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func decodeSOA(msg []byte, start int, end int) (RDATA, error) {
+	mname, offset, err := parseDomainName(msg[:end], start)
+	if err != nil {
+		return nil, err
+	}
+	rname, offset, err := parseDomainName(msg[:end], offset)
+	if err != nil {
+		return nil, err
+	}
+	if end-offset != 20 {
+		return nil, fmt.Errorf("%d bytes after the names, expected 20", end-offset)
+	}
+
+	timer := func(i int) uint32 {
+		return binary.BigEndian.Uint32(msg[offset+4*i : offset+4*i+4])
+	}
+	return SOAData{
+		MName:   mname,
+		RName:   rname,
+		Serial:  timer(0),
+		Refresh: timer(1),
+		Retry:   timer(2),
+		Expire:  timer(3),
+		Minimum: timer(4),
+	}, nil
+}
+
+func parseSOAData(fields []string) (RDATA, error) {
+	if len(fields) != 7 {
+		return nil, fmt.Errorf("expected <mname> <rname> <serial> <refresh> <retry> <expire> <minimum>, got %q", strings.Join(fields, " "))
+	}
+	names := [2]string{}
+	for i, field := range fields[:2] {
+		name, err := parseName(field)
+		if err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+	timers := [5]uint32{}
+	for i, field := range fields[2:] {
+		value, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", field)
+		}
+		timers[i] = uint32(value)
+	}
+
+	return SOAData{
+		MName:   names[0],
+		RName:   names[1],
+		Serial:  timers[0],
+		Refresh: timers[1],
+		Retry:   timers[2],
+		Expire:  timers[3],
+		Minimum: timers[4],
+	}, nil
+}
+
+func (data SOAData) encode(buf []byte, names *compressor) ([]byte, error) {
+	buf, err := names.appendName(buf, data.MName)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = names.appendName(buf, data.RName); err != nil {
+		return nil, err
+	}
+	for _, timer := range []uint32{data.Serial, data.Refresh, data.Retry, data.Expire, data.Minimum} {
+		buf = binary.BigEndian.AppendUint32(buf, timer)
+	}
+
+	return buf, nil
+}
+
+func (data SOAData) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(data.MName), fqdn(data.RName),
+		data.Serial, data.Refresh, data.Retry, data.Expire, data.Minimum)
+}
+
+// MXData is the RDATA of an MX record: a mail exchanger and its preference, lower first.
+type MXData struct {
+	Preference uint16
+	Exchange   string
+}
+
+func decodeMX(msg []byte, start int, end int) (RDATA, error) {
+	if end-start < 3 {
+		return nil, fmt.Errorf("RDATA is %d bytes, too short for a preference and a name", end-start)
+	}
+	exchange, err := decodeNameRDATA(msg, start+2, end)
+	if err != nil {
+		return nil, err
+	}
+
+	return MXData{Preference: binary.BigEndian.Uint16(msg[start : start+2]), Exchange: exchange}, nil
+}
+
+func parseMXData(fields []string) (RDATA, error) {
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("expected <preference> <exchange>, got %q", strings.Join(fields, " "))
+	}
+	preference, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preference %q", fields[0])
+	}
+	exchange, err := parseName(fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return MXData{Preference: uint16(preference), Exchange: exchange}, nil
+}
+
+func (data MXData) encode(buf []byte, names *compressor) ([]byte, error) {
+	return names.appendName(binary.BigEndian.AppendUint16(buf, data.Preference), data.Exchange)
+}
+
+func (data MXData) String() string {
+	return fmt.Sprintf("%d %s", data.Preference, fqdn(data.Exchange))
+}
+
+// TXTData is the RDATA of a TXT record: one or more character-strings of up to 255
+// bytes each (RFC 1035 section 3.3.14). Clients such as SPF checkers join them, so a
+// longer text is split across several strings.
+type TXTData struct {
+	Strings []string
+}
+
+func decodeTXT(msg []byte, start int, end int) (RDATA, error) {
+	if start == end {
+		return nil, fmt.Errorf("RDATA is empty, expected at least one character-string")
+	}
+
+	data := TXTData{}
+	for offset := start; offset < end; {
+		length := int(msg[offset])
+		if offset+1+length > end {
+			return nil, fmt.Errorf("character-string of %d bytes runs past its RDLENGTH", length)
+		}
+		data.Strings = append(data.Strings, string(msg[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+
+	return data, nil
+}
+
+// parseTXTData takes each field as one text, quoted if it has spaces, and splits texts
+// longer than 255 bytes into as many character-strings as they need.
+func parseTXTData(fields []string) (RDATA, error) {
+	data := TXTData{}
+	for _, text := range fields {
+		for len(text) > 255 {
+			data.Strings = append(data.Strings, text[:255])
+			text = text[255:]
+		}
+		data.Strings = append(data.Strings, text)
+	}
+
+	return data, nil
+}
+
+func (data TXTData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	if len(data.Strings) == 0 {
+		return nil, fmt.Errorf("no character-strings")
+	}
+	for _, text := range data.Strings {
+		if len(text) > 255 {
+			return nil, fmt.Errorf("character-string of %d bytes is longer than 255", len(text))
+		}
+		buf = append(append(buf, byte(len(text))), text...)
+	}
+
+	return buf, nil
+}
+
+func (data TXTData) String() string {
+	quoted := make([]string, len(data.Strings))
+	for i, text := range data.Strings {
+		quoted[i] = quoteString(text)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// quoteString returns the presentation form of a character-string (RFC 1035 section
+// 5.1): in double quotes, with quotes and backslashes escaped by a backslash and bytes
+// outside printable ASCII written as \DDD.
+func quoteString(text string) string {
+	return `"` + escapeString(text, `"\`) + `"`
+}
+
+// escapeString escapes the bytes of text that are in special, or aren't printable
+// ASCII, the way RFC 1035 section 5.1 does.
+func escapeString(text string, special string) string {
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case strings.IndexByte(special, c) >= 0:
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&out, "\\%03d", c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.String()
+}
+
+// parseNameField parses the presentation form of RDATA that is a single name and
+// returns the name without its trailing dot.
+func parseNameField(fields []string, what string) (string, error) {
+	if len(fields) != 1 {
+		return "", fmt.Errorf("expected a single %s, got %q", what, strings.Join(fields, " "))
+	}
+
+	return parseName(fields[0])
+}
+
+// parseName checks a name given in the records file or on the command line and
+// returns it as it goes on the wire, without the trailing dot. Unicode labels are
+// converted to A-labels here and only here, so names taken from messages are always
+// written back byte for byte.
+func parseName(name string) (string, error) {
+	ascii, err := toASCII(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return "", fmt.Errorf("%q: %v", name, err)
+	}
+	if _, err := encodeName(ascii); err != nil {
+		return "", fmt.Errorf("%q: %v", name, err)
+	}
+
+	return ascii, nil
+}
+
+// parseNames is parseName for each name of a list.
+func parseNames(names []string) ([]string, error) {
+	parsed := []string{}
+	for _, name := range names {
+		ascii, err := parseName(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, ascii)
+	}
+
+	return parsed, nil
+}
+
+// SRVData is the RDATA of an SRV record: a server for the service and protocol in the
+// owner name, such as _ldap._tcp.example.com, with its port (RFC 2782). Clients try
+// the lowest priority first and spread load by weight within a priority.
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func decodeSRV(msg []byte, start int, end int) (RDATA, error) {
+	if end-start < 7 {
+		return nil, fmt.Errorf("RDATA is %d bytes, too short for priority, weight, port and a name", end-start)
+	}
+	target, err := decodeNameRDATA(msg, start+6, end) // compressed by some servers despite RFC 2782
+	if err != nil {
+		return nil, err
+	}
+
+	return SRVData{
+		Priority: binary.BigEndian.Uint16(msg[start : start+2]),
+		Weight:   binary.BigEndian.Uint16(msg[start+2 : start+4]),
+		Port:     binary.BigEndian.Uint16(msg[start+4 : start+6]),
+		Target:   target,
+	}, nil
+}
+
+func parseSRVData(fields []string) (RDATA, error) {
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("expected <priority> <weight> <port> <target>, got %q", strings.Join(fields, " "))
+	}
+	numbers := [3]uint16{}
+	for i, field := range fields[:3] {
+		value, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", field)
+		}
+		numbers[i] = uint16(value)
+	}
+	target, err := parseNameField(fields[3:], "target name")
+	if err != nil {
+		return nil, err
+	}
+
+	return SRVData{Priority: numbers[0], Weight: numbers[1], Port: numbers[2], Target: target}, nil
+}
+
+// encode writes the target in full, since RFC 2782 forbids compressing it.
+func (data SRVData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	buf = binary.BigEndian.AppendUint16(buf, data.Priority)
+	buf = binary.BigEndian.AppendUint16(buf, data.Weight)
+	buf = binary.BigEndian.AppendUint16(buf, data.Port)
+	target, err := encodeName(data.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(buf, target...), nil
+}
+
+func (data SRVData) String() string {
+	return fmt.Sprintf("%d %d %d %s", data.Priority, data.Weight, data.Port, fqdn(data.Target))
+}
+
+// decodeNameRDATA decodes RDATA that is a single, possibly compressed, name.
+func decodeNameRDATA(msg []byte, start int, end int) (string, error) {
+	name, next, err := parseDomainName(msg[:end], start)
+	if err != nil {
+		return "", err
+	}
+	if next != end {
+		return "", fmt.Errorf("%d bytes left over after the name", end-next)
+	}
+
+	return name, nil
+}
+
+// UnknownData is the RDATA of a type without its own implementation, kept opaque in
+// wire format as RFC 3597 requires, so records of any type survive being decoded and
+// encoded again. The few older types that may compress names have them written out
+// in full, since their pointers would be wrong in another message.
+type UnknownData []byte
+
+// parseUnknownData parses the generic presentation form of RFC 3597 section 5,
+// "\# <length> <hex>...", which can give the RDATA of any type.
+func parseUnknownData(fields []string) (UnknownData, error) {
+	if len(fields) < 2 || fields[0] != `\#` {
+		return nil, fmt.Errorf(`expected \# <length> <hex>, got %q`, strings.Join(fields, " "))
+	}
+	length, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDATA length %q", fields[1])
+	}
+	data, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex RDATA: %v", err)
+	}
+	if len(data) != int(length) {
+		return nil, fmt.Errorf("RDATA is %d bytes, not the %d given", len(data), length)
+	}
+
+	return UnknownData(data), nil
+}
+
+func (data UnknownData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	return append(buf, data...), nil
+}
+
+// String uses the generic form of RFC 3597 section 5.
+func (data UnknownData) String() string {
+	if len(data) == 0 {
+		return `\# 0`
+	}
+
+	return fmt.Sprintf("\\# %d %s", len(data), hex.EncodeToString(data))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRDATAString(t *testing.T) {
+	tests := []struct {
+		name string
+		data RDATA
+		want string
+	}{
+		{name: "A", data: AData{IP: net.IPv4(192, 0, 2, 1).To4()}, want: "192.0.2.1"},
+		{name: "AAAA", data: AAAAData{IP: net.ParseIP("2001:db8::1")}, want: "2001:db8::1"},
+		{name: "CNAME", data: CNAMEData{Target: "www.example.net"}, want: "www.example.net."},
+		{name: "MX", data: MXData{Preference: 10, Exchange: "mail.example.com"}, want: "10 mail.example.com."},
+		{name: "SRV", data: SRVData{Priority: 1, Weight: 2, Port: 53, Target: "ns1.example.com"}, want: "1 2 53 ns1.example.com."},
+		{name: "SOA", data: SOAData{MName: "ns.lan", RName: "admin.lan", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5},
+			want: "ns.lan. admin.lan. 1 2 3 4 5"},
+		{name: "TXT", data: TXTData{Strings: []string{"v=spf1 -all", ""}}, want: `"v=spf1 -all" ""`},
+		{name: "TXT escapes", data: TXTData{Strings: []string{"say \"hi\" \\ \x00\xff\n"}}, want: `"say \"hi\" \\ \000\255\010"`},
+		{name: "SVCB", data: SVCBData{Priority: 1, Params: []SvcParam{
+			{Key: 0, Value: []byte{0, 1, 0, 3}},
+			{Key: 1, Value: []byte("\x02h2\x02h3")},
+			{Key: 2},
+			{Key: 3, Value: []byte{0x20, 0xFB}},
+			{Key: 4, Value: []byte{192, 0, 2, 1, 192, 0, 2, 2}},
+			{Key: 5, Value: []byte("ECH")},
+			{Key: 6, Value: net.ParseIP("2001:db8::1")},
+		}}, want: "1 . mandatory=alpn,port alpn=h2,h3 no-default-alpn port=8443 ipv4hint=192.0.2.1,192.0.2.2 ech=RUNI ipv6hint=2001:db8::1"},
+		{name: "SVCB alias", data: SVCBData{Priority: 0, Target: "pool.example.net"}, want: "0 pool.example.net."},
+		{name: "SVCB escaped ALPN", data: SVCBData{Priority: 1, Params: []SvcParam{{Key: 1, Value: []byte("\x03a,b\x02c\\")}}},
+			want: `1 . alpn=a\,b,c\\`},
+		{name: "SVCB generic keys", data: SVCBData{Priority: 1, Params: []SvcParam{
+			{Key: 3, Value: []byte{1}},
+			{Key: 7, Value: []byte("/dns-query{?dns}")},
+			{Key: 65000},
+		}}, want: `1 . key3="\001" key7="/dns-query{?dns}" key65000`},
+		{name: "OPT", data: OPTData{Options: []EDNSOption{{Code: 10, Data: []byte{1, 2}}, {Code: 12}}}, want: "; OPTION 10: 0102\n; OPTION 12: "},
+		{name: "unknown", data: UnknownData{0xDE, 0xAD}, want: `\# 2 dead`},
+		{name: "unknown and empty", data: UnknownData{}, want: `\# 0`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.data.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSVCBStringParses checks that the presentation form of SVCB RDATA is what the
+// records file takes.
+func TestSVCBStringParses(t *testing.T) {
+	data := SVCBData{Priority: 1, Target: "svc.example.com", Params: []SvcParam{
+		{Key: 1, Value: []byte("\x02h2\x02h3")},
+		{Key: 3, Value: []byte{0x20, 0xFB}},
+		{Key: 4, Value: []byte{192, 0, 2, 1}},
+		{Key: 6, Value: net.ParseIP("2001:db8::1")},
+	}}
+
+	parsed, err := parseSVCBData(strings.Fields(data.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, data) {
+		t.Errorf("got %+v, want %+v", parsed, data)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transport identifies how a query reached the server.
+type Transport string
+
+const (
+	TransportUDP  Transport = "udp"
+	TransportTCP  Transport = "tcp"
+	TransportUnix Transport = "unix" // length-prefixed over a Unix stream socket
+)
+
+// RequestContext carries what the handler knows about a query besides its bytes, so
+// policies, logging and truncation decisions can depend on how it arrived.
+type RequestContext struct {
+	ClientAddr      net.Addr
+	Transport       Transport
+	ReceivedAt      time.Time
+	MaxResponseSize int    // largest response the client accepts on this transport
+	DeviceID        string // MAC address of the client device, "" if not identified
+	EDNS            *EDNS  // the client's OPT record, nil if it sent none
+
+	write func([]byte) error // sends a response back over the query's transport
+}
+
+// newUDPRequest describes a query received on a UDP socket. The response size limit is
+// 512 bytes unless the client advertised a larger EDNS payload size. The response is
+// sent with the control messages oob, which can pin its source address.
+func newUDPRequest(query []byte, udpConn *net.UDPConn, source *net.UDPAddr, oob []byte) *RequestContext {
+	return &RequestContext{
+		ClientAddr:      source,
+		Transport:       TransportUDP,
+		ReceivedAt:      time.Now(),
+		MaxResponseSize: udpPayloadSize(query),
+		write: func(response []byte) error {
+			_, _, err := udpConn.WriteMsgUDP(response, oob, source)
+			return err
+		},
+	}
+}
+
+// clientIP returns the IP address the query came from.
+func (req *RequestContext) clientIP() net.IP {
+	switch addr := req.ClientAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+
+	return nil
+}
+
+// respond sends a response to the client, after the plugins have seen it. A client
+// that sent an OPT record gets one back even in answers built locally. Responses
+// larger than the client accepts are truncated, with TC set when records it asked
+// for had to go, so it retries over TCP.
+func (req *RequestContext) respond(response []byte) error {
+	if req.EDNS != nil && !hasOPT(response) {
+		response = appendOPT(response, EDNS{DO: req.EDNS.DO})
+	}
+
+	if changed, err := runResponsePlugins(req, response); err != nil {
+		fmt.Println(err)
+	} else {
+		response = changed
+	}
+
+	if req.MaxResponseSize > 0 {
+		response = fitResponse(response, req.MaxResponseSize)
+	}
+
+	traceMessage("Response to", req.ClientAddr, response)
+	return req.write(response)
+}
+
+// udpPayloadSize returns the largest UDP response the client accepts: the payload size
+// from its OPT record if it sent one, and never less than the classic 512 bytes.
+func udpPayloadSize(query []byte) int {
+	if len(query) < 12 {
+		return 512
+	}
+
+	_, offset, err := parseQuestions(query, 12, int(binary.BigEndian.Uint16(query[4:6])))
+	if err != nil {
+		return 512
+	}
+	start, _ := findOPT(query, offset)
+	if start < 0 {
+		return 512
+	}
+
+	_, typeOffset, _ := parseDomainName(query, start) // findOPT only returns complete records
+	return max(int(binary.BigEndian.Uint16(query[typeOffset+2:typeOffset+4])), 512)
+}
+
+// hasOPT reports whether a message carries an OPT record.
+func hasOPT(msg []byte) bool {
+	if len(msg) < 12 {
+		return false
+	}
+
+	_, offset, err := parseQuestions(msg, 12, int(binary.BigEndian.Uint16(msg[4:6])))
+	if err != nil {
+		return false
+	}
+	start, _ := findOPT(msg, offset)
+	return start >= 0
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// selfAddrPollInterval is how often interface addresses are re-detected.
+const selfAddrPollInterval = 30 * time.Second
+
+// SelfNames answers configured hostnames (e.g. router.lan) with the server's own
+// interface addresses, which are re-detected periodically so they follow DHCP or
+// interface changes.
+type SelfNames struct {
+	names map[string]bool // lowercased, without trailing dot
+	ttl   uint32          // TTL of the answers
+
+	mu   sync.RWMutex
+	ipv4 []net.IP
+	ipv6 []net.IP
+}
+
+// NewSelfNames creates the local zone for the given names, answered with the given TTL,
+// and starts watching the interfaces.
+func NewSelfNames(names []string, ttl uint32) *SelfNames {
+	selfNames := &SelfNames{names: map[string]bool{}, ttl: ttl}
+	for _, name := range names {
+		selfNames.names[canonicalName(name)] = true
+	}
+
+	if len(selfNames.names) > 0 {
+		selfNames.refresh()
+		go selfNames.watch()
+	}
+
+	return selfNames
+}
+
+// refresh re-reads the interface addresses. Loopback addresses are only used when the
+// host has no other address of that family.
+func (s *SelfNames) refresh() {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		fmt.Println("Failed to read interface addresses:", err)
+		return
+	}
+
+	var ipv4, ipv6, loopback4, loopback6 []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ip := ipNet.IP
+		switch {
+		case ip.To4() != nil && ip.IsLoopback():
+			loopback4 = append(loopback4, ip.To4())
+		case ip.To4() != nil:
+			ipv4 = append(ipv4, ip.To4())
+		case ip.IsLoopback():
+			loopback6 = append(loopback6, ip)
+		default:
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	if len(ipv4) == 0 {
+		ipv4 = loopback4
+	}
+	if len(ipv6) == 0 {
+		ipv6 = loopback6
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ipv4 = ipv4
+	s.ipv6 = ipv6
+}
+
+// watch refreshes the interface addresses every selfAddrPollInterval.
+func (s *SelfNames) watch() {
+	for range time.Tick(selfAddrPollInterval) {
+		s.refresh()
+	}
+}
+
+// answer returns the A or AAAA records for a question about one of the server's names.
+// The boolean is false if the name is not one of ours; other QTYPEs get no records (NODATA).
+func (s *SelfNames) answer(question DNSQuestion) ([]ResourceRecord, bool) {
+	if !s.names[canonicalName(question.Name)] || (question.Class != classIN && question.Class != classANY) {
+		return nil, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := []ResourceRecord{}
+	record := ResourceRecord{Name: question.Name, Type: question.Type, Class: classIN, TTL: s.ttl}
+	switch question.Type {
+	case typeA:
+		for _, ip := range s.ipv4 {
+			record.Data = AData{IP: ip}
+			records = append(records, record)
+		}
+	case typeAAAA:
+		for _, ip := range s.ipv6 {
+			record.Data = AAAAData{IP: ip}
+			records = append(records, record)
+		}
+	}
+
+	return records, true
+}
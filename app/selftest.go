@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+)
+
+// buildQuery creates a recursive A/IN query for the given name with the given packet ID.
+func buildQuery(id uint16, name string) []byte {
+	header := DNSHeader{
+		ID:      id,
+		RD:      1,
+		QDCOUNT: 1,
+	}
+
+	query := header.toBytes()
+	query = append(query, encodeDomainName(name)...)
+	query = append(query, 0x00, 0x01) // TYPE A
+	query = append(query, 0x00, 0x01) // CLASS IN
+
+	return query
+}
+
+// runSelfTest resolves each canary name through every resolver and logs the outcome.
+// It returns an error only if every query failed, meaning the resolution path is unusable.
+func runSelfTest(canaries []string, upstreams []*Upstream) error {
+	failures := 0
+	for i, name := range canaries {
+		for _, upstream := range upstreams {
+			if !selfTestCanary(uint16(i+1), name, upstream) {
+				failures++
+			}
+		}
+	}
+
+	if failures == len(canaries)*len(upstreams) {
+		return fmt.Errorf("all %d canary queries failed", failures)
+	}
+
+	return nil
+}
+
+// selfTestCanary sends a single canary query to a resolver and logs whether it was answered.
+func selfTestCanary(id uint16, name string, upstream *Upstream) bool {
+	resolverAddr := upstream.Addr
+	response, err := upstream.exchange(buildQuery(id, name))
+	if err != nil {
+		fmt.Printf("Self-test %s via %s: %v\n", name, resolverAddr, err)
+		return false
+	}
+
+	if len(response) < 12 {
+		fmt.Printf("Self-test %s via %s: short response\n", name, resolverAddr)
+		return false
+	}
+
+	rcode := messageRCode(response)
+	if rcode != rcodeNoError && rcode != rcodeNXDomain { // both prove the resolver works
+		fmt.Printf("Self-test %s via %s: %s\n", name, resolverAddr, rcode)
+		return false
+	}
+
+	fmt.Printf("Self-test %s via %s: OK\n", name, resolverAddr)
+	return true
+}
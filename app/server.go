@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Server holds everything handleQuery needs to answer a query: the local answer
+// sources that are consulted first and the forwarder used for everything else.
+type Server struct {
+	Forwarder  *Forwarder
+	Policy     *QTypePolicy
+	SelfNames  *SelfNames
+	Records    *LocalRecords
+	IPNames    *IPNames
+	MDNSBridge bool   // resolve .local names with multicast DNS on the LAN
+	MaxTTL     uint32 // cap applied to TTLs in relayed responses, 0 for no cap
+	DoHCanary  bool   // answer the browser DoH canary domain with NXDOMAIN
+
+	IdentifyDevices bool             // fill in RequestContext.DeviceID from EDNS or the neighbour table
+	MACSources      []*net.IPNet     // clients trusted to pass a device's MAC in EDNS, such as the CPE
+	Inflight        *InflightLimiter // cap on queries processed at once, nil for none
+	Mirror          *Mirror          // gets copies of a sample of forwarded queries, nil for none
+	StreamConns     chan struct{}    // one per stream connection being served, nil for no limit
+
+	pending  sync.WaitGroup // queries being answered, waited for when draining
+	draining atomic.Bool    // the sockets were handed to an upgraded process
+	mode     atomic.Int32   // serveMode, switched with SetMode
+}
+
+// serveUDP answers the queries read from udpConn until reading fails, each on its own
+// goroutine. When reading stops because the socket was handed to an upgraded process,
+// the queries still being answered are waited for first.
+func (s *Server) serveUDP(udpConn *net.UDPConn) {
+	buf := make([]byte, maxMessageSize) // EDNS lets queries exceed 512 bytes (RFC 6891 section 6.2.5)
+	oob := make([]byte, pktinfoBufferSize)
+
+	for {
+		size, oobSize, _, source, err := udpConn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			if s.draining.Load() {
+				s.drain()
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Println("Error receiving data:", err)
+			}
+			return
+		}
+
+		// A datagram that fills the buffer may have been cut short by the read
+		if size == len(buf) {
+			fmt.Printf("Dropping datagram from %s that doesn't fit %d bytes\n", source, len(buf))
+			continue
+		}
+
+		// Each query gets its own copy, the buffer is reused right away
+		query := append([]byte{}, buf[:size]...)
+		req := newUDPRequest(query, udpConn, source, replySource(oob[:oobSize]))
+		if !s.admit(req, query) {
+			continue
+		}
+		go func() {
+			defer s.finish()
+			s.handleQuery(req, query)
+		}()
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The results of the benchmarks at the last performance-related change are kept in
+// testdata/benchmarks.txt. To see what a change does to them, run
+//
+//	go test -run '^$' -bench . -count 5 ./app > new.txt
+//	benchstat app/testdata/benchmarks.txt new.txt
+//
+// and update the file along with the change if it is intended.
+
+// BenchmarkUDPRoundTrip measures a query answered from local records over loopback,
+// from the client's write to its read of the response, through the same read loop
+// the server runs.
+func BenchmarkUDPRoundTrip(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "records")
+	if err := os.WriteFile(path, []byte("www.example.com 300 A 10.0.0.1\n"), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	records, err := LoadLocalRecords(path, 60)
+	if err != nil {
+		b.Fatal(err)
+	}
+	server := &Server{
+		Forwarder: &Forwarder{EDNSOptions: &EDNSOptionPolicy{}},
+		Policy:    &QTypePolicy{},
+		SelfNames: NewSelfNames(nil, 60),
+		Records:   records,
+		IPNames:   NewIPNames(nil, 60),
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer udpConn.Close()
+	go server.serveUDP(udpConn)
+
+	client, err := net.DialUDP("udp", nil, udpConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer client.Close()
+
+	query := benchmarkQuery(b)
+	response := make([]byte, maxMessageSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(query); err != nil {
+			b.Fatal(err)
+		}
+		size, err := client.Read(response)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if size < 12 || response[3]&0x0F != 0 {
+			b.Fatalf("unexpected response %x", response[:size])
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Variables rather than constants so tests can shorten them.
+var (
+	streamIdleTimeout  = 10 * time.Second // how long a client stream connection may sit without sending a query
+	streamWriteTimeout = 5 * time.Second  // how long a response may take to be taken by the client
+)
+
+// listenUnix opens a Unix stream socket at path. A socket left behind by a previous
+// run is removed first; any other file at the path is an error.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// serveStream accepts connections from a stream listener and answers the DNS messages
+// sent over them, each framed with a two-byte length prefix as over TCP (RFC 1035
+// section 4.2.2). Every connection is served on its own goroutine. Once
+// s.StreamConns is full, new connections are left waiting in the listen backlog until
+// a served one closes.
+func (s *Server) serveStream(listener net.Listener, transport Transport) {
+	for {
+		if s.StreamConns != nil {
+			s.StreamConns <- struct{}{}
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.StreamConns != nil {
+				<-s.StreamConns
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("Failed to accept %s connection: %v\n", transport, err)
+			time.Sleep(100 * time.Millisecond) // don't spin on persistent errors such as EMFILE
+			continue
+		}
+
+		go s.serveStreamConn(conn, transport)
+	}
+}
+
+// serveStreamConn answers queries on one connection until the client closes it, sends
+// a broken frame or stays idle for streamIdleTimeout. Pipelined queries are answered
+// concurrently, each response as soon as it is ready (RFC 7766 section 6.2.1.1), and
+// the connection is closed once the last of them is sent.
+func (s *Server) serveStreamConn(conn net.Conn, transport Transport) {
+	var inflight sync.WaitGroup
+	defer func() {
+		inflight.Wait()
+		conn.Close()
+		if s.StreamConns != nil {
+			<-s.StreamConns
+		}
+	}()
+
+	var writeMu sync.Mutex // responses must not interleave
+	prefix := make([]byte, 2)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(streamIdleTimeout)); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, prefix); err != nil {
+			return
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(prefix))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			fmt.Printf("Failed to read query from %s connection: %v\n", transport, err)
+			return
+		}
+
+		req := newStreamRequest(conn, transport, &writeMu)
+		if !s.admit(req, query) {
+			continue
+		}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer s.finish()
+			s.handleQuery(req, query)
+		}()
+	}
+}
+
+// newStreamRequest describes a query received on a stream connection, where any
+// response that fits a length prefix can be sent. Writes hold writeMu, shared by the
+// queries of the connection, for at most streamWriteTimeout: a client that stops
+// reading has its connection closed, as what was written of a frame can't be undone.
+func newStreamRequest(conn net.Conn, transport Transport, writeMu *sync.Mutex) *RequestContext {
+	return &RequestContext{
+		ClientAddr:      conn.RemoteAddr(),
+		Transport:       transport,
+		ReceivedAt:      time.Now(),
+		MaxResponseSize: maxMessageSize,
+		write: func(response []byte) error {
+			framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(response)), uint16(len(response)))
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if err := conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+				return err
+			}
+			if _, err := conn.Write(append(framed, response...)); err != nil {
+				conn.Close() // also ends the read loop
+				return err
+			}
+			return nil
+		},
+	}
+}
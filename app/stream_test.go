@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setStreamTimeouts shortens the stream timeouts for the test. The old values are put
+// back once every server started after the call has stopped.
+func setStreamTimeouts(t *testing.T, idle, write time.Duration) {
+	oldIdle, oldWrite := streamIdleTimeout, streamWriteTimeout
+	t.Cleanup(func() { streamIdleTimeout, streamWriteTimeout = oldIdle, oldWrite })
+	streamIdleTimeout, streamWriteTimeout = idle, write
+}
+
+// startStreamServer serves records over TCP on a loopback port, with room for conns
+// connections at once, until the test ends.
+func startStreamServer(t *testing.T, records string, conns int) (*Server, string) {
+	t.Helper()
+
+	server := newLocalServer(t, records)
+	server.StreamConns = make(chan struct{}, conns)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.serveStream(listener, TransportTCP)
+	t.Cleanup(func() {
+		// Taking every slot waits for the accept loop and each connection to finish
+		listener.Close()
+		for i := 0; i < conns; i++ {
+			select {
+			case server.StreamConns <- struct{}{}:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%d stream connections still served", conns-i)
+			}
+		}
+	})
+
+	return server, listener.Addr().String()
+}
+
+// dialStream connects to a stream server, closing the connection when the test ends.
+func dialStream(t *testing.T, addr string) *framedConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &framedConn{t: t, conn: conn}
+}
+
+// waitStreamConns waits for the server to be down to open stream slots: one for each
+// connection being served, and one for the accept loop.
+func waitStreamConns(t *testing.T, server *Server, open int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.StreamConns) > open {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d stream slots taken, want %d", len(server.StreamConns), open)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// frame prefixes a message with its length, as it goes over a stream.
+func frame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+}
+
+func TestServeStreamFraming(t *testing.T) {
+	one, two := frame(testQuery(t, 1, "nas.lan")), frame(testQuery(t, 2, "nas.lan"))
+
+	tests := []struct {
+		name   string
+		writes [][]byte // sent one after another, with a pause between them
+		want   []uint16 // IDs of the responses, in any order
+	}{
+		{name: "one query", writes: [][]byte{one}, want: []uint16{1}},
+		{name: "pipelined in one write", writes: [][]byte{append(append([]byte{}, one...), two...)}, want: []uint16{1, 2}},
+		{name: "length prefix split", writes: [][]byte{one[:1], one[1:]}, want: []uint16{1}},
+		{name: "message split", writes: [][]byte{one[:5], one[5:20], one[20:]}, want: []uint16{1}},
+		{name: "next query in the same write", writes: [][]byte{append(append([]byte{}, one...), two[:3]...), two[3:]}, want: []uint16{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startStreamServer(t, "nas.lan A 10.0.0.10\n", 4)
+			client := dialStream(t, addr)
+
+			for _, data := range tt.writes {
+				if _, err := client.conn.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := []uint16{}
+			for range tt.want {
+				response := client.read()
+				var msg DNSMessage
+				if err := msg.Unmarshal(response); err != nil {
+					t.Fatalf("response %x doesn't parse: %v", response, err)
+				}
+				if len(msg.Answers) != 1 {
+					t.Errorf("response %d has %d answers, want 1", msg.Header.ID, len(msg.Answers))
+				}
+				got = append(got, msg.Header.ID)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got responses %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestServeStreamClosesConnections checks the connections the server gives up on:
+// broken frames and idle clients.
+func TestServeStreamClosesConnections(t *testing.T) {
+	setStreamTimeouts(t, 100*time.Millisecond, time.Second)
+
+	tests := []struct {
+		name          string
+		send          []byte
+		wantResponses int
+	}{
+		{name: "message cut short", send: frame(testQuery(t, 1, "nas.lan"))[:10]},
+		{name: "length prefix cut short", send: []byte{0}},
+		{name: "idle", send: nil},
+		{name: "idle after a query", send: frame(testQuery(t, 1, "nas.lan")), wantResponses: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := startStreamServer(t, "nas.lan A 10.0.0.10\n", 4)
+			client := dialStream(t, addr)
+			if _, err := client.conn.Write(tt.send); err != nil {
+				t.Fatal(err)
+			}
+
+			// The server closes the connection well before the client's deadline
+			client.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			responses := 0
+			for client.read() != nil {
+				responses++
+			}
+			if responses != tt.wantResponses {
+				t.Errorf("got %d responses, want %d", responses, tt.wantResponses)
+			}
+			if _, err := client.conn.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Error("connection still open")
+			}
+		})
+	}
+}
+
+// TestServeStreamConnectionCap checks that a connection past the cap waits to be
+// served until another one closes.
+func TestServeStreamConnectionCap(t *testing.T) {
+	_, addr := startStreamServer(t, "nas.lan A 10.0.0.10\n", 1)
+	first, second := dialStream(t, addr), dialStream(t, addr)
+
+	first.write(testQuery(t, 1, "nas.lan"))
+	first.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if first.read() == nil {
+		t.Fatal("no response on the first connection")
+	}
+
+	second.write(testQuery(t, 2, "nas.lan"))
+	second.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if response := second.read(); response != nil {
+		t.Fatalf("got response %x past the connection cap", response)
+	}
+
+	first.conn.Close()
+	second.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if second.read() == nil {
+		t.Error("no response once the first connection closed")
+	}
+}
+
+// TestServeStreamStalledReader checks that a client that pipelines queries but doesn't
+// read the responses has its connection closed, freeing its slot.
+func TestServeStreamStalledReader(t *testing.T) {
+	setStreamTimeouts(t, time.Second, 100*time.Millisecond)
+
+	// Responses of about 54 KB each, so a few fill the socket buffers
+	records := strings.Repeat("big.lan TXT "+strings.Repeat("x", 255)+"\n", 200)
+	server, addr := startStreamServer(t, records, 2)
+
+	client := dialStream(t, addr)
+	if err := client.conn.(*net.TCPConn).SetReadBuffer(4096); err != nil {
+		t.Fatal(err)
+	}
+	query, err := (&DNSMessage{Header: DNSHeader{ID: 1}, Questions: []DNSQuestion{{Name: "big.lan", Type: typeTXT, Class: classIN}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.conn.Write([]byte(strings.Repeat(string(frame(query)), 300))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the accept loop's slot is left once the connection closed
+	waitStreamConns(t, server, 1)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// addStubZones parses a comma-separated list of ZONE=<ip>:<port> entries, sending
+// queries for names at or below each ZONE to its servers, such as internal
+// authoritative servers, instead of the default resolvers. A ZONE listed more than
+// once gets its servers in the order given.
+func (f *Forwarder) addStubZones(list string) error {
+	for _, entry := range splitList(list) {
+		zone, address, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("expected ZONE=<ip>:<port>, got %q", entry)
+		}
+		zone, err := parseName(zone)
+		if err != nil {
+			return err
+		}
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			return fmt.Errorf("invalid server address in %q: %v", entry, err)
+		}
+
+		if f.ZoneUpstreams == nil {
+			f.ZoneUpstreams = map[string][]*Upstream{}
+		}
+		key := canonicalName(zone)
+		f.ZoneUpstreams[key] = append(f.ZoneUpstreams[key], NewUpstream(addr))
+	}
+
+	return nil
+}
+
+// addInsecureZones parses a comma-separated list of zones whose answers aren't to be
+// DNSSEC-validated upstream, like unbound's domain-insecure.
+func (f *Forwarder) addInsecureZones(list string) error {
+	for _, zone := range splitList(list) {
+		zone, err := parseName(zone)
+		if err != nil {
+			return err
+		}
+		if f.InsecureZones == nil {
+			f.InsecureZones = map[string]bool{}
+		}
+		f.InsecureZones[canonicalName(zone)] = true
+	}
+
+	return nil
+}
+
+// isInsecure reports whether a name is at or below one of the insecure zones.
+func (f *Forwarder) isInsecure(name string) bool {
+	for _, zone := range enclosingZones(name) {
+		if f.InsecureZones[zone] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enclosingZones returns a name and every zone above it, closest first, lowercased and
+// without trailing dots, ending with "" for the root.
+func enclosingZones(name string) []string {
+	zones := []string{}
+	for zone := canonicalName(name); zone != ""; {
+		zones = append(zones, zone)
+		_, zone, _ = strings.Cut(zone, ".")
+	}
+
+	return append(zones, "")
+}
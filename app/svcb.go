@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// svcParamNames maps the SvcParamKey mnemonics of RFC 9460 section 14.3.2 to their codes.
+var svcParamNames = map[string]uint16{
+	"mandatory":       0,
+	"alpn":            1,
+	"no-default-alpn": 2,
+	"port":            3,
+	"ipv4hint":        4,
+	"ech":             5,
+	"ipv6hint":        6,
+}
+
+// SVCBData is the RDATA of an SVCB or HTTPS record (RFC 9460). Priority 0 makes it an
+// alias for Target; otherwise Target serves the owner's service with the given
+// parameters, lower priorities first. A Target of "" stands for the owner itself.
+type SVCBData struct {
+	Priority uint16
+	Target   string
+	Params   []SvcParam // in increasing Key order, as the wire format requires
+}
+
+// SvcParam is one service parameter, with its value in wire format.
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+func decodeSVCB(msg []byte, start int, end int) (RDATA, error) {
+	if end-start < 3 {
+		return nil, fmt.Errorf("RDATA is %d bytes, too short for a priority and a name", end-start)
+	}
+	target, offset, err := parseDomainName(msg[:end], start+2)
+	if err != nil {
+		return nil, err
+	}
+
+	data := SVCBData{Priority: binary.BigEndian.Uint16(msg[start : start+2]), Target: target}
+	for offset < end {
+		if end-offset < 4 {
+			return nil, fmt.Errorf("SvcParam header runs past its RDLENGTH")
+		}
+		key := binary.BigEndian.Uint16(msg[offset : offset+2])
+		length := int(binary.BigEndian.Uint16(msg[offset+2 : offset+4]))
+		if offset+4+length > end {
+			return nil, fmt.Errorf("SvcParam %s runs past its RDLENGTH", svcParamName(key))
+		}
+		if count := len(data.Params); count > 0 && key <= data.Params[count-1].Key {
+			return nil, fmt.Errorf("SvcParam %s is out of order", svcParamName(key))
+		}
+		data.Params = append(data.Params, SvcParam{Key: key, Value: append([]byte{}, msg[offset+4:offset+4+length]...)})
+		offset += 4 + length
+	}
+
+	return data, nil
+}
+
+// parseSVCBData parses "<priority> <target> [<key>[=<value>]...]", such as
+// "1 . alpn=h2,h3 port=8443 ipv4hint=192.0.2.1". Values are comma-separated lists for
+// mandatory, alpn and the hints, base64 for ech and taken as is for keyNNNNN.
+func parseSVCBData(fields []string) (RDATA, error) {
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected <priority> <target> [<params>], got %q", strings.Join(fields, " "))
+	}
+	priority, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid priority %q", fields[0])
+	}
+	target, err := parseNameField(fields[1:2], "target name")
+	if err != nil {
+		return nil, err
+	}
+
+	data := SVCBData{Priority: uint16(priority), Target: target}
+	for _, field := range fields[2:] {
+		name, value, _ := strings.Cut(field, "=")
+		key, err := parseSvcParamKey(name)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := encodeSvcParamValue(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
+		for _, param := range data.Params {
+			if param.Key == key {
+				return nil, fmt.Errorf("%s is given more than once", name)
+			}
+		}
+		data.Params = append(data.Params, SvcParam{Key: key, Value: encoded})
+	}
+	sort.Slice(data.Params, func(i, j int) bool { return data.Params[i].Key < data.Params[j].Key })
+
+	return data, nil
+}
+
+// encode writes the target in full, since RFC 9460 section 2.2 forbids compressing it.
+func (data SVCBData) encode(buf []byte, _ *compressor) ([]byte, error) {
+	target, err := encodeName(data.Target)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(binary.BigEndian.AppendUint16(buf, data.Priority), target...)
+
+	for i, param := range data.Params {
+		if i > 0 && param.Key <= data.Params[i-1].Key {
+			return nil, fmt.Errorf("SvcParam %s is out of order", svcParamName(param.Key))
+		}
+		if len(param.Value) > 0xFFFF {
+			return nil, fmt.Errorf("SvcParam %s of %d bytes is too long", svcParamName(param.Key), len(param.Value))
+		}
+		buf = binary.BigEndian.AppendUint16(buf, param.Key)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(param.Value)))
+		buf = append(buf, param.Value...)
+	}
+
+	return buf, nil
+}
+
+func (data SVCBData) String() string {
+	fields := []string{strconv.Itoa(int(data.Priority)), fqdn(data.Target)}
+	for _, param := range data.Params {
+		fields = append(fields, param.String())
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// String returns the parameter in the key=value form parseSVCBData reads, with lists
+// comma-separated and commas or backslashes inside ALPN IDs escaped. A value that
+// doesn't decode for its key is shown in the generic form, keyNNNNN="<value>".
+func (param SvcParam) String() string {
+	if value, ok := formatSvcParamValue(param.Key, param.Value); ok {
+		if value == "" {
+			return svcParamName(param.Key)
+		}
+		return svcParamName(param.Key) + "=" + value
+	}
+	if len(param.Value) == 0 {
+		return fmt.Sprintf("key%d", param.Key)
+	}
+
+	return fmt.Sprintf("key%d=%s", param.Key, quoteString(string(param.Value)))
+}
+
+// formatSvcParamValue decodes the wire format of a SvcParam value into its
+// presentation form, the reverse of encodeSvcParamValue. It reports false if the
+// value is malformed for its key, or the key has no presentation of its own.
+func formatSvcParamValue(key uint16, value []byte) (string, bool) {
+	items := []string{}
+	switch key {
+	case 0: // mandatory
+		if len(value) == 0 || len(value)%2 != 0 {
+			return "", false
+		}
+		for i := 0; i < len(value); i += 2 {
+			items = append(items, svcParamName(binary.BigEndian.Uint16(value[i:i+2])))
+		}
+	case 1: // alpn
+		for i := 0; i < len(value); i += 1 + int(value[i]) {
+			if value[i] == 0 || i+1+int(value[i]) > len(value) {
+				return "", false
+			}
+			items = append(items, escapeString(string(value[i+1:i+1+int(value[i])]), `,\`))
+		}
+		if len(items) == 0 {
+			return "", false
+		}
+	case 2: // no-default-alpn
+		return "", len(value) == 0
+	case 3: // port
+		if len(value) != 2 {
+			return "", false
+		}
+		return strconv.Itoa(int(binary.BigEndian.Uint16(value))), true
+	case 4, 6: // ipv4hint, ipv6hint
+		size := net.IPv4len
+		if key == 6 {
+			size = net.IPv6len
+		}
+		if len(value) == 0 || len(value)%size != 0 {
+			return "", false
+		}
+		for i := 0; i < len(value); i += size {
+			items = append(items, net.IP(value[i:i+size]).String())
+		}
+	case 5: // ech
+		if len(value) == 0 {
+			return "", false
+		}
+		return base64.StdEncoding.EncodeToString(value), true
+	default:
+		return "", false
+	}
+
+	return strings.Join(items, ","), true
+}
+
+// parseSvcParamKey converts a SvcParamKey mnemonic or generic "keyNNNNN" into its code.
+func parseSvcParamKey(name string) (uint16, error) {
+	if key, ok := svcParamNames[strings.ToLower(name)]; ok {
+		return key, nil
+	}
+	if number, ok := strings.CutPrefix(strings.ToLower(name), "key"); ok {
+		if key, err := strconv.ParseUint(number, 10, 16); err == nil {
+			return uint16(key), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown SvcParam %q", name)
+}
+
+// svcParamName returns the mnemonic of a SvcParamKey, or keyNNNNN for keys without one.
+func svcParamName(key uint16) string {
+	for name, code := range svcParamNames {
+		if code == key {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("key%d", key)
+}
+
+// encodeSvcParamValue encodes the presentation value of a SvcParam in wire format
+// (RFC 9460 section 7).
+func encodeSvcParamValue(key uint16, value string) ([]byte, error) {
+	encoded := []byte{}
+	switch key {
+	case 0: // mandatory
+		for _, name := range strings.Split(value, ",") {
+			code, err := parseSvcParamKey(name)
+			if err != nil {
+				return nil, err
+			}
+			encoded = binary.BigEndian.AppendUint16(encoded, code)
+		}
+	case 1: // alpn
+		for _, id := range strings.Split(value, ",") {
+			if id == "" || len(id) > 255 {
+				return nil, fmt.Errorf("protocol ID %q must be 1 to 255 bytes", id)
+			}
+			encoded = append(append(encoded, byte(len(id))), id...)
+		}
+	case 2: // no-default-alpn
+		if value != "" {
+			return nil, fmt.Errorf("takes no value")
+		}
+	case 3: // port
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("expected a port number, got %q", value)
+		}
+		encoded = binary.BigEndian.AppendUint16(encoded, uint16(port))
+	case 4, 6: // ipv4hint, ipv6hint
+		for _, address := range strings.Split(value, ",") {
+			ip := net.ParseIP(address)
+			switch {
+			case ip != nil && key == 4 && ip.To4() != nil:
+				encoded = append(encoded, ip.To4()...)
+			case ip != nil && key == 6 && ip.To4() == nil:
+				encoded = append(encoded, ip...)
+			default:
+				return nil, fmt.Errorf("invalid address %q", address)
+			}
+		}
+	case 5: // ech
+		config, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("expected base64, got %q", value)
+		}
+		encoded = config
+	default:
+		encoded = []byte(value)
+	}
+
+	return encoded, nil
+}
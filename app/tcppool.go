@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	tcpPoolSize    = 2                // established connections kept per upstream
+	tcpIdleTimeout = 10 * time.Second // connections with no queries for this long are closed
+)
+
+// tcpPool keeps a small number of established TCP connections to an upstream and
+// multiplexes queries over them, so each TCP query doesn't pay for a new handshake.
+type tcpPool struct {
+	addr    *net.TCPAddr
+	timeout time.Duration // how long a query waits for its response
+
+	mu    sync.Mutex
+	conns []*tcpConn
+}
+
+// tcpConn is a pooled TCP connection. Queries are written with a connection-local
+// message ID and responses are matched back to the waiting query by that ID and the
+// echoed question, so responses arriving out of order, late or twice are never
+// handed to the wrong query.
+type tcpConn struct {
+	conn *net.TCPConn
+	pool *tcpPool
+
+	mu      sync.Mutex
+	nextID  uint16 // IDs are handed out sequentially, so an ID is only reused after 65536 queries
+	pending map[uint16]*tcpPending
+	closed  bool
+}
+
+// tcpPending is a query waiting for its response on a pooled connection.
+type tcpPending struct {
+	query []byte // as sent, with the connection-local ID
+	reply chan []byte
+}
+
+// exchange sends a query over a pooled connection and waits for its response. The
+// resolver may have closed a connection that sat in the pool, which only shows once
+// it is used, so a query that fails on a reused connection is tried once more on a
+// new one.
+func (p *tcpPool) exchange(query []byte) ([]byte, error) {
+	c, reused, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	response, broken, err := c.exchange(query)
+	if broken && reused {
+		if c, err = p.dial(); err != nil {
+			return nil, err
+		}
+		response, _, err = c.exchange(query)
+	}
+
+	return response, err
+}
+
+// get returns the least busy pooled connection, and true as it was already open, or
+// dials a new one if every existing connection has queries in flight and the pool
+// still has room.
+func (p *tcpPool) get() (*tcpConn, bool, error) {
+	p.mu.Lock()
+	var best *tcpConn
+	for _, c := range p.conns {
+		if best == nil || c.load() < best.load() {
+			best = c
+		}
+	}
+	if best != nil && (best.load() == 0 || len(p.conns) >= tcpPoolSize) {
+		p.mu.Unlock()
+		return best, true, nil
+	}
+	p.mu.Unlock()
+
+	c, err := p.dial()
+	return c, false, err
+}
+
+// dial opens a new connection and adds it to the pool. The dial happens outside the
+// pool's lock so a slow resolver doesn't hold up queries on the open connections,
+// which lets the pool briefly exceed its size when several queries dial at once.
+func (p *tcpPool) dial() (*tcpConn, error) {
+	dialer := net.Dialer{Timeout: upstreamTimeout}
+	conn, err := dialer.Dial("tcp", p.addr.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial resolver over TCP: %v", err)
+	}
+
+	c := &tcpConn{
+		conn:    conn.(*net.TCPConn),
+		pool:    p,
+		pending: map[uint16]*tcpPending{},
+	}
+	p.mu.Lock()
+	p.conns = append(p.conns, c)
+	p.mu.Unlock()
+	go c.readLoop()
+
+	return c, nil
+}
+
+// remove drops a closed connection from the pool.
+func (p *tcpPool) remove(c *tcpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, conn := range p.conns {
+		if conn == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// load returns the number of queries waiting for a response on the connection.
+func (c *tcpConn) load() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.pending)
+}
+
+// exchange writes a length-prefixed query under a fresh message ID and waits for the
+// matching response, restoring the caller's ID before returning it. It also reports
+// whether the query failed because the connection broke, rather than the resolver
+// being slow, in which case it can be retried on another connection.
+func (c *tcpConn) exchange(query []byte) ([]byte, bool, error) {
+	if len(query) < 12 {
+		return nil, false, fmt.Errorf("query too short to forward")
+	}
+	originalID := binary.BigEndian.Uint16(query[0:2])
+
+	message := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	message = append(message, query...)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, true, fmt.Errorf("connection to resolver closed")
+	}
+
+	id := c.nextID
+	for _, inUse := c.pending[id]; inUse; _, inUse = c.pending[id] {
+		id++
+	}
+	c.nextID = id + 1
+	binary.BigEndian.PutUint16(message[2:4], id)
+
+	reply := make(chan []byte, 1)
+	c.pending[id] = &tcpPending{query: message[2:], reply: reply}
+
+	// Each query pushes the idle deadline out; an idle connection times out its read and is reaped
+	c.conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+	c.conn.SetWriteDeadline(time.Now().Add(upstreamTimeout))
+	_, err := c.conn.Write(message)
+	c.mu.Unlock()
+
+	if err != nil {
+		c.close()
+		return nil, true, fmt.Errorf("failed to send query to resolver over TCP: %v", err)
+	}
+
+	timer := time.NewTimer(c.pool.timeout)
+	defer timer.Stop()
+
+	select {
+	case response, ok := <-reply:
+		if !ok {
+			return nil, true, fmt.Errorf("connection to resolver closed")
+		}
+		binary.BigEndian.PutUint16(response[0:2], originalID)
+		return response, false, nil
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, false, fmt.Errorf("timed out waiting for resolver over TCP")
+	}
+}
+
+// readLoop reads length-prefixed responses and hands each one to the query waiting for
+// its ID, provided it echoes that query's question. Anything else (a duplicate, a late
+// answer to a query that already timed out, or a mismatched question) is dropped.
+func (c *tcpConn) readLoop() {
+	defer c.close()
+
+	prefix := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.conn, prefix); err != nil {
+			return
+		}
+
+		response := make([]byte, binary.BigEndian.Uint16(prefix))
+		if _, err := io.ReadFull(c.conn, response); err != nil {
+			return
+		}
+		if len(response) < 12 {
+			continue
+		}
+
+		id := binary.BigEndian.Uint16(response[0:2])
+		c.mu.Lock()
+		pending, ok := c.pending[id]
+		if ok && matchesQuery(pending.query, response) {
+			delete(c.pending, id)
+		} else {
+			ok = false
+		}
+		c.mu.Unlock()
+
+		if ok {
+			pending.reply <- response
+		} else {
+			fmt.Printf("Dropping unexpected TCP response %d from %s\n", id, c.pool.addr)
+		}
+	}
+}
+
+// close shuts the connection, fails any queries still waiting on it, and removes it from the pool.
+func (c *tcpConn) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	for id, pending := range c.pending {
+		close(pending.reply)
+		delete(c.pending, id)
+	}
+	c.mu.Unlock()
+
+	c.pool.remove(c)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// framedConn is one end of a connection carrying length-prefixed DNS messages, such as
+// the resolver end of a connection from a tcpPool under test.
+type framedConn struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+// read returns the next length-prefixed message, or nil once the other end closed the connection.
+func (u *framedConn) read() []byte {
+	prefix := make([]byte, 2)
+	if _, err := io.ReadFull(u.conn, prefix); err != nil {
+		return nil
+	}
+	query := make([]byte, binary.BigEndian.Uint16(prefix))
+	if _, err := io.ReadFull(u.conn, query); err != nil {
+		return nil
+	}
+
+	return query
+}
+
+// write sends a length-prefixed message.
+func (u *framedConn) write(msg []byte) {
+	if _, err := u.conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err != nil {
+		u.t.Errorf("write: %v", err)
+	}
+}
+
+// startTCPUpstream accepts connections on a loopback port until the test ends and runs
+// serve on each, with the number of connections accepted before it. The connection is
+// closed when serve returns.
+func startTCPUpstream(t *testing.T, serve func(u *framedConn, n int)) *tcpPool {
+	t.Helper()
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(&framedConn{t: t, conn: conn}, n)
+			}()
+		}
+	}()
+
+	return &tcpPool{addr: listener.Addr().(*net.TCPAddr), timeout: 200 * time.Millisecond}
+}
+
+// closeAll closes the pool's connections.
+func (p *tcpPool) closeAll() {
+	p.mu.Lock()
+	conns := append([]*tcpConn{}, p.conns...)
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// withQuestion returns a response to query that echoes another name.
+func withQuestion(t *testing.T, query []byte, name string) []byte {
+	var msg DNSMessage
+	if err := msg.Unmarshal(query); err != nil {
+		t.Fatal(err)
+	}
+	msg.Header.QR = 1
+	msg.Questions[0].Name = name
+	response, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+// TestTCPPoolMatchesResponses checks that responses on a pooled connection reach the
+// query they answer, with the query's own ID, however they arrive.
+func TestTCPPoolMatchesResponses(t *testing.T) {
+	const clientID = 0xBEEF
+
+	tests := []struct {
+		name       string
+		queries    []string // names asked, in order, or all at once if concurrent
+		concurrent bool
+		serve      func(u *framedConn)
+		wantErr    []bool // for each query
+	}{
+		{name: "answered in order", queries: []string{"a.lan", "b.lan"}, concurrent: true, serve: func(u *framedConn) {
+			first, second := u.read(), u.read()
+			if first[0] == second[0] && first[1] == second[1] {
+				u.t.Errorf("queries in flight together share the ID %x", first[:2])
+			}
+			u.write(reply(first))
+			u.write(reply(second))
+		}, wantErr: []bool{false, false}},
+		{name: "answered out of order", queries: []string{"a.lan", "b.lan"}, concurrent: true, serve: func(u *framedConn) {
+			first, second := u.read(), u.read()
+			u.write(reply(second))
+			u.write(reply(first))
+		}, wantErr: []bool{false, false}},
+		{name: "answer to another question dropped", queries: []string{"a.lan"}, serve: func(u *framedConn) {
+			query := u.read()
+			u.write(withQuestion(u.t, query, "spoofed.lan"))
+			u.write(reply(query))
+		}, wantErr: []bool{false}},
+		{name: "duplicate answer dropped", queries: []string{"a.lan", "b.lan"}, serve: func(u *framedConn) {
+			first := u.read()
+			u.write(reply(first))
+			u.write(reply(first))
+			u.write(reply(u.read()))
+		}, wantErr: []bool{false, false}},
+		{name: "late answer after a timeout dropped", queries: []string{"a.lan", "b.lan"}, serve: func(u *framedConn) {
+			first := u.read()
+			second := u.read() // sent once the first query timed out
+			u.write(reply(first))
+			u.write(reply(second))
+		}, wantErr: []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTCPUpstream(t, func(u *framedConn, n int) {
+				if n > 0 {
+					t.Errorf("pool opened %d connections, want 1", n+1)
+				}
+				tt.serve(u)
+				u.read() // keep the connection open until the pool closes it
+			})
+			t.Cleanup(p.closeAll)
+
+			// One connection, so the concurrent queries share it rather than get one each
+			c, err := p.dial()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ask := func(i int) {
+				response, _, err := c.exchange(testQuery(t, clientID, tt.queries[i]))
+				if tt.wantErr[i] {
+					if err == nil {
+						t.Errorf("%s: got response %x, want an error", tt.queries[i], response)
+					}
+					return
+				}
+				if err != nil {
+					t.Errorf("%s: unexpected error: %v", tt.queries[i], err)
+					return
+				}
+
+				var msg DNSMessage
+				if err := msg.Unmarshal(response); err != nil {
+					t.Errorf("%s: response doesn't parse: %v", tt.queries[i], err)
+					return
+				}
+				if msg.Header.ID != clientID || msg.Questions[0].Name != tt.queries[i] {
+					t.Errorf("%s: got the answer to %s with ID %x, want ID %x", tt.queries[i], msg.Questions[0].Name, msg.Header.ID, clientID)
+				}
+			}
+
+			if !tt.concurrent {
+				for i := range tt.queries {
+					ask(i)
+				}
+				return
+			}
+			var wg sync.WaitGroup
+			for i := range tt.queries {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ask(i)
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// TestTCPPoolClosedConnections checks that a connection the resolver closed leaves the
+// pool and that the queries after it get through on a new one.
+func TestTCPPoolClosedConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		serve   func(u *framedConn, n int)
+		wantErr []bool // for each of two queries in a row
+	}{
+		{name: "closed with a query in flight", serve: func(u *framedConn, n int) {
+			query := u.read()
+			if n > 0 {
+				u.write(reply(query))
+				u.read()
+			}
+		}, wantErr: []bool{true, false}},
+		{name: "reused connection closed before answering", serve: func(u *framedConn, n int) {
+			u.write(reply(u.read()))
+			if n == 0 {
+				u.read() // the second query goes unanswered, for the pool to retry on a new connection
+				return
+			}
+			u.read()
+		}, wantErr: []bool{false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startTCPUpstream(t, tt.serve)
+			t.Cleanup(p.closeAll)
+
+			for i, wantErr := range tt.wantErr {
+				_, err := p.exchange(testQuery(t, uint16(i), "a.lan"))
+				if wantErr != (err != nil) {
+					t.Errorf("query %d: got error %v, want one: %v", i+1, err, wantErr)
+				}
+				if err == nil {
+					continue
+				}
+
+				// The broken connection is evicted, so the next query doesn't use it
+				deadline := time.Now().Add(time.Second)
+				for {
+					p.mu.Lock()
+					open := len(p.conns)
+					p.mu.Unlock()
+					if open == 0 {
+						break
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("%d connections still pooled after EOF, want none", open)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
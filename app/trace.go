@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// traceMessages enables the dig-style dump of every query and response, set once from the command line.
+var traceMessages bool
+
+// traceMessage logs a rendering of a message exchanged with a client when tracing is enabled.
+func traceMessage(direction string, peer net.Addr, msg []byte) {
+	if !traceMessages {
+		return
+	}
+
+	fmt.Printf(";; %s %s, %d bytes\n%s\n", direction, peer, len(msg), formatMessage(msg))
+}
+
+// formatMessage renders a DNS message the way dig prints it, see DNSMessage.String.
+// Malformed messages are reported with a hex dump instead.
+func formatMessage(msg []byte) string {
+	if err := validateMessage(msg); err != nil {
+		return fmt.Sprintf(";; malformed message: %v\n;; %s\n", err, hex.EncodeToString(msg))
+	}
+
+	var m DNSMessage
+	if err := m.Unmarshal(msg); err != nil {
+		return fmt.Sprintf(";; malformed message: %v\n;; %s\n", err, hex.EncodeToString(msg))
+	}
+
+	return m.String()
+}
+
+// String renders the message the way dig prints it: the header and flags, the EDNS
+// pseudo-section, then every section with RDATA decoded for the common types.
+func (m *DNSMessage) String() string {
+	var out strings.Builder
+	flags := messageFlags(m.Header.toBytes())
+	rcode := m.Header.RCODE & 0x0F
+	if edns, ok := m.EDNS(); ok {
+		rcode |= RCode(edns.ExtendedRCode) << 4
+	}
+
+	fmt.Fprintf(&out, ";; ->>HEADER<<- opcode: %s, status: %s, id: %d\n", flags.opcode(), rcode, m.Header.ID)
+	fmt.Fprintf(&out, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		flags, len(m.Questions), len(m.Answers), len(m.Authority), len(m.Additionals))
+
+	// Keep the OPT record out of the additional section
+	sections := [3][]string{}
+	opt := ""
+	for i, records := range [][]ResourceRecord{m.Answers, m.Authority, m.Additionals} {
+		for _, record := range records {
+			if record.Type == typeOPT {
+				opt = record.String() + "\n"
+				continue
+			}
+			sections[i] = append(sections[i], record.String())
+		}
+	}
+
+	if opt != "" {
+		fmt.Fprintf(&out, "\n;; OPT PSEUDOSECTION:\n%s", opt)
+	}
+
+	if len(m.Questions) > 0 {
+		out.WriteString("\n;; QUESTION SECTION:\n")
+		for _, question := range m.Questions {
+			fmt.Fprintf(&out, ";%s\t\t%s\t%s\n", fqdn(question.Name), question.Class, question.Type)
+		}
+	}
+
+	for i, title := range []string{"ANSWER", "AUTHORITY", "ADDITIONAL"} {
+		if len(sections[i]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "\n;; %s SECTION:\n%s\n", title, strings.Join(sections[i], "\n"))
+	}
+
+	return out.String()
+}
+
+// String renders the record as a line of dig's output: owner, TTL, class, type and
+// RDATA in presentation format. OPT records are rendered as the EDNS fields they carry.
+func (record ResourceRecord) String() string {
+	data := record.Data
+	if data == nil {
+		data = UnknownData{}
+	}
+
+	if record.Type == typeOPT {
+		return formatOPT(uint16(record.Class), record.TTL, data)
+	}
+
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(record.Name), record.TTL, record.Class, record.Type, data)
+}
+
+// formatOPT renders the EDNS fields an OPT record packs into its class, TTL and RDATA.
+func formatOPT(size uint16, ttl uint32, data RDATA) string {
+	flags := ""
+	if ttl&0x8000 != 0 {
+		flags = " do"
+	}
+
+	out := fmt.Sprintf("; EDNS: version: %d, flags:%s; udp: %d", (ttl>>16)&0xFF, flags, size)
+	if options := data.String(); options != "" {
+		out += "\n" + options
+	}
+
+	return out
+}
+
+// formatRDATA renders the RDATA between start and end in presentation format through
+// the RDATA type of rtype. RDATA that doesn't decode uses the generic \# form of RFC 3597.
+func formatRDATA(msg []byte, rtype QType, start int, end int) string {
+	data, err := decodeRDATA(msg, rtype, start, end)
+	if err != nil {
+		return UnknownData(msg[start:end]).String()
+	}
+
+	return data.String()
+}
+
+// fqdn returns a parsed name in absolute form, with its trailing dot.
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
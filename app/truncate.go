@@ -0,0 +1,77 @@
+package main
+
+import "encoding/binary"
+
+// fitResponse trims a response so it is at most limit bytes long. Whole records are
+// dropped from the end, so additional records go first, then authority, then answers;
+// cutting from the end keeps every remaining compression pointer valid and always
+// yields the same result for the same input. A trailing OPT record is preserved. TC is
+// set if any answer or authority record had to go, telling the client to retry over TCP.
+func fitResponse(response []byte, limit int) []byte {
+	if len(response) <= limit || len(response) < 12 {
+		return response
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(response[4:6]))
+	ancount := int(binary.BigEndian.Uint16(response[6:8]))
+	nscount := int(binary.BigEndian.Uint16(response[8:10]))
+	arcount := int(binary.BigEndian.Uint16(response[10:12]))
+	_, questionsEnd, err := parseQuestions(response, 12, qdcount)
+	if err != nil {
+		return response
+	}
+
+	// Find where each record ends
+	ends := []int{}
+	offset := questionsEnd
+	optStart := -1
+	for i := 0; i < ancount+nscount+arcount; i++ {
+		start := offset
+		_, typeOffset, err := parseDomainName(response, offset)
+		if err != nil {
+			break
+		}
+		if offset, err = skipRecord(response, offset); err != nil {
+			break
+		}
+
+		if i == ancount+nscount+arcount-1 && i >= ancount+nscount &&
+			QType(binary.BigEndian.Uint16(response[typeOffset:typeOffset+2])) == typeOPT {
+			optStart = start
+			break
+		}
+		ends = append(ends, offset)
+	}
+
+	var opt []byte
+	if optStart >= 0 {
+		opt = response[optStart:offset]
+	}
+
+	// Keep as many leading records as fit alongside the OPT record
+	kept := len(ends)
+	for kept > 0 && ends[kept-1]+len(opt) > limit {
+		kept--
+	}
+	cut := questionsEnd
+	if kept > 0 {
+		cut = ends[kept-1]
+	}
+
+	trimmed := append(append([]byte{}, response[:cut]...), opt...)
+	keptAnswers := min(kept, ancount)
+	keptAuthority := min(max(kept-ancount, 0), nscount)
+	keptAdditional := kept - keptAnswers - keptAuthority
+	if opt != nil {
+		keptAdditional++
+	}
+	binary.BigEndian.PutUint16(trimmed[6:8], uint16(keptAnswers))
+	binary.BigEndian.PutUint16(trimmed[8:10], uint16(keptAuthority))
+	binary.BigEndian.PutUint16(trimmed[10:12], uint16(keptAdditional))
+
+	if keptAnswers < ancount || keptAuthority < nscount {
+		binary.BigEndian.PutUint16(trimmed[2:4], uint16(messageFlags(trimmed)|flagTC))
+	}
+
+	return trimmed
+}
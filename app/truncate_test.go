@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// testResponse builds a response to example.com A with four answers, an additional
+// address for ns.example.com and an OPT record, 123 bytes in all.
+func testResponse(t *testing.T) []byte {
+	t.Helper()
+
+	msg := DNSMessage{
+		Header:    DNSHeader{ID: 1, QR: 1, RD: 1, RA: 1},
+		Questions: []DNSQuestion{{Name: "example.com", Type: typeA, Class: classIN}},
+		Additionals: []ResourceRecord{
+			{Name: "ns.example.com", Type: typeA, Class: classIN, TTL: 60, Data: AData{IP: net.IPv4(10, 0, 0, 53).To4()}},
+			EDNS{UDPSize: 1232}.record(),
+		},
+	}
+	for i := 1; i <= 4; i++ {
+		msg.Answers = append(msg.Answers, ResourceRecord{Name: "example.com", Type: typeA, Class: classIN, TTL: 300,
+			Data: AData{IP: net.IPv4(10, 0, 0, byte(i)).To4()}})
+	}
+
+	response, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response) != 123 {
+		t.Fatalf("test response is %d bytes, expected 123", len(response))
+	}
+
+	return response
+}
+
+func TestFitResponse(t *testing.T) {
+	tests := []struct {
+		name       string
+		limit      int
+		wantSize   int
+		answers    int
+		additional int // the OPT record included
+		wantTC     bool
+	}{
+		{name: "fits with room", limit: 512, wantSize: 123, answers: 4, additional: 2},
+		{name: "fits exactly", limit: 123, wantSize: 123, answers: 4, additional: 2},
+		{name: "additional record dropped", limit: 122, wantSize: 104, answers: 4, additional: 1},
+		{name: "answer dropped", limit: 103, wantSize: 88, answers: 3, additional: 1, wantTC: true},
+		{name: "every answer dropped", limit: 44, wantSize: 40, answers: 0, additional: 1, wantTC: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fitted := fitResponse(testResponse(t), tt.limit)
+			if len(fitted) != tt.wantSize {
+				t.Errorf("got %d bytes, want %d", len(fitted), tt.wantSize)
+			}
+
+			var msg DNSMessage
+			if err := msg.Unmarshal(fitted); err != nil {
+				t.Fatalf("trimmed response doesn't parse: %v", err)
+			}
+			if len(msg.Answers) != tt.answers || len(msg.Additionals) != tt.additional {
+				t.Errorf("got %d answers and %d additional records, want %d and %d",
+					len(msg.Answers), len(msg.Additionals), tt.answers, tt.additional)
+			}
+			if _, ok := msg.EDNS(); !ok {
+				t.Errorf("OPT record was dropped")
+			}
+			if tc := msg.Header.TC == 1; tc != tt.wantTC {
+				t.Errorf("got TC %v, want %v", tc, tt.wantTC)
+			}
+		})
+	}
+}
+
+func TestFitResponseShortMessage(t *testing.T) {
+	short := []byte{0, 1, 0x81, 0x80}
+	if fitted := fitResponse(short, 2); string(fitted) != string(short) {
+		t.Errorf("got %x, want a message shorter than a header left as it is", fitted)
+	}
+}
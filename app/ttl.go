@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+)
+
+// rrsetKey identifies an RRset: records with the same owner name, type and class.
+type rrsetKey struct {
+	name  string // lowercased, names compare case-insensitively
+	rtype QType
+	class uint16
+}
+
+// normalizeTTLs rewrites the TTLs of a response in place following RFC 2181: a TTL
+// with the most significant bit set is treated as zero (section 8), TTLs above maxTTL
+// are capped, and every record of an RRset gets the lowest TTL of the set (section 5.2).
+// When the answer follows a CNAME chain, every RRset of the chain gets the lowest TTL
+// of the chain, so no part of it outlives the aliases leading to it. Zero TTLs are
+// kept, so the answer stays usable once but is never cached.
+func normalizeTTLs(response []byte, maxTTL uint32) {
+	if len(response) < 12 {
+		return
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(response[4:6]))
+	count := int(binary.BigEndian.Uint16(response[6:8])) + // ANCOUNT
+		int(binary.BigEndian.Uint16(response[8:10])) + // NSCOUNT
+		int(binary.BigEndian.Uint16(response[10:12])) // ARCOUNT
+	questions, offset, err := parseQuestions(response, 12, qdcount)
+	if err != nil {
+		return
+	}
+	ancount := int(binary.BigEndian.Uint16(response[6:8]))
+
+	ttlOffsets := map[rrsetKey][]int{}
+	lowest := map[rrsetKey]uint32{}
+	answers := []rrsetKey{}          // RRsets of the answer section, in order
+	aliases := map[rrsetKey]string{} // CNAME RRsets of the answer section to their target
+	for i := 0; i < count && offset < len(response); i++ {
+		name, typeOffset, err := parseDomainName(response, offset)
+		if err != nil || typeOffset+10 > len(response) {
+			return
+		}
+
+		rtype := QType(binary.BigEndian.Uint16(response[typeOffset : typeOffset+2]))
+		class := binary.BigEndian.Uint16(response[typeOffset+2 : typeOffset+4])
+		ttl := binary.BigEndian.Uint32(response[typeOffset+4 : typeOffset+8])
+		offset = typeOffset + 10 + int(binary.BigEndian.Uint16(response[typeOffset+8:typeOffset+10]))
+
+		if rtype == typeOPT { // the OPT TTL field holds EDNS flags, not a TTL
+			continue
+		}
+
+		if ttl > math.MaxInt32 {
+			ttl = 0
+		}
+		if maxTTL > 0 && ttl > maxTTL {
+			ttl = maxTTL
+		}
+
+		key := rrsetKey{name: foldCase(name), rtype: rtype, class: class}
+		if current, seen := lowest[key]; !seen || ttl < current {
+			lowest[key] = ttl
+		}
+		ttlOffsets[key] = append(ttlOffsets[key], typeOffset+4)
+
+		if i < ancount {
+			answers = append(answers, key)
+			if rtype == typeCNAME && offset <= len(response) {
+				if target, _, err := parseDomainName(response[:offset], typeOffset+10); err == nil {
+					aliases[key] = canonicalName(target)
+				}
+			}
+		}
+	}
+	if offset > len(response) { // last record runs past the end, leave the message alone
+		return
+	}
+
+	if len(questions) == 1 {
+		if chain := aliasChain(questions[0].Name, answers, aliases); len(chain) > 1 {
+			chainTTL := lowest[chain[0]]
+			for _, key := range chain {
+				chainTTL = min(chainTTL, lowest[key])
+			}
+			for _, key := range chain {
+				lowest[key] = chainTTL
+			}
+		}
+	}
+
+	for key, offsets := range ttlOffsets {
+		for _, ttlOffset := range offsets {
+			binary.BigEndian.PutUint32(response[ttlOffset:ttlOffset+4], lowest[key])
+		}
+	}
+}
+
+// aliasChain returns the answer RRsets along the CNAME chain starting at name: each
+// CNAME in turn, then the other RRsets owned by the name the chain ends at. A chain
+// that loops stops where it comes back.
+func aliasChain(name string, answers []rrsetKey, aliases map[rrsetKey]string) []rrsetKey {
+	chain := []rrsetKey{}
+	visited := map[string]bool{}
+	for name = canonicalName(name); !visited[name]; {
+		visited[name] = true
+
+		next, found := "", false
+		for _, key := range answers {
+			if target, ok := aliases[key]; ok && key.name == name {
+				next, found = target, true
+				chain = append(chain, key)
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		name = next
+	}
+
+	for i, key := range answers {
+		if key.name == name && key.rtype != typeCNAME && !slices.Contains(answers[:i], key) {
+			chain = append(chain, key)
+		}
+	}
+
+	return chain
+}
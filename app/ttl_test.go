@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeTTLs(t *testing.T) {
+	a := func(name string, ttl uint32, last byte) ResourceRecord {
+		return ResourceRecord{Name: name, Type: typeA, Class: classIN, TTL: ttl, Data: AData{IP: net.IPv4(10, 0, 0, last).To4()}}
+	}
+	cname := func(name string, ttl uint32, target string) ResourceRecord {
+		return ResourceRecord{Name: name, Type: typeCNAME, Class: classIN, TTL: ttl, Data: CNAMEData{Target: target}}
+	}
+	opt := EDNS{UDPSize: 1232, DO: true}.record()
+
+	tests := []struct {
+		name       string
+		qname      string
+		maxTTL     uint32
+		answers    []ResourceRecord
+		additional []ResourceRecord
+		want       []uint32 // TTLs of every record in order, the OPT record's included
+	}{
+		{name: "lowest of the RRset", qname: "a.lan", answers: []ResourceRecord{a("a.lan", 300, 1), a("a.lan", 100, 2)},
+			want: []uint32{100, 100}},
+		{name: "RRsets apart", qname: "a.lan", answers: []ResourceRecord{a("a.lan", 300, 1)},
+			additional: []ResourceRecord{a("b.lan", 100, 2)}, want: []uint32{300, 100}},
+		{name: "owner case ignored", qname: "a.lan", answers: []ResourceRecord{a("a.lan", 300, 1), a("A.LAN", 100, 2)},
+			want: []uint32{100, 100}},
+		{name: "most significant bit set", qname: "a.lan", answers: []ResourceRecord{a("a.lan", 300, 1), a("a.lan", 0x80000001, 2)},
+			want: []uint32{0, 0}},
+		{name: "capped", qname: "a.lan", maxTTL: 3600, answers: []ResourceRecord{a("a.lan", 2000000, 1)}, want: []uint32{3600}},
+		{name: "no cap", qname: "a.lan", answers: []ResourceRecord{a("a.lan", 2000000, 1)}, want: []uint32{2000000}},
+		{name: "CNAME chain", qname: "alias.lan",
+			answers: []ResourceRecord{cname("alias.lan", 300, "mid.lan"), cname("mid.lan", 30, "www.lan"), a("www.lan", 600, 1)},
+			want:    []uint32{30, 30, 30}},
+		{name: "records off the chain", qname: "alias.lan",
+			answers: []ResourceRecord{cname("alias.lan", 30, "www.lan"), a("www.lan", 600, 1), a("other.lan", 600, 2)},
+			want:    []uint32{30, 30, 600}},
+		{name: "OPT flags left alone", qname: "a.lan", answers: []ResourceRecord{a("a.lan", 300, 1)},
+			additional: []ResourceRecord{opt}, want: []uint32{300, opt.TTL}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := DNSMessage{
+				Header:      DNSHeader{ID: 1, QR: 1},
+				Questions:   []DNSQuestion{{Name: tt.qname, Type: typeA, Class: classIN}},
+				Answers:     tt.answers,
+				Additionals: tt.additional,
+			}
+			response, err := msg.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			normalizeTTLs(response, tt.maxTTL)
+
+			var normalized DNSMessage
+			if err := normalized.Unmarshal(response); err != nil {
+				t.Fatalf("normalized response doesn't parse: %v", err)
+			}
+			got := []uint32{}
+			for _, record := range append(normalized.Answers, normalized.Additionals...) {
+				got = append(got, record.TTL)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got TTLs %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
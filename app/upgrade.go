@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inheritEnv tells a process started by an upgrade which inherited file descriptors
+// hold the listening sockets, as comma-separated name=fd pairs such as "udp=3,tcp=4".
+const inheritEnv = "DNS_INHERITED_SOCKETS"
+
+// drainTimeout bounds how long a process that handed its sockets over waits for the
+// queries it is still answering.
+const drainTimeout = 2 * upstreamTimeout
+
+// inheritedSocket returns the socket a previous process handed over under name, or
+// nil if this process was not started by an upgrade.
+func inheritedSocket(name string) *os.File {
+	for _, entry := range splitList(os.Getenv(inheritEnv)) {
+		key, value, _ := strings.Cut(entry, "=")
+		if fd, err := strconv.Atoi(value); key == name && err == nil {
+			return os.NewFile(uintptr(fd), name)
+		}
+	}
+
+	return nil
+}
+
+// listenUDPOrInherit takes over the UDP socket of the process being upgraded, if there
+// is one, and otherwise binds a new one.
+func listenUDPOrInherit(addr *net.UDPAddr) (*net.UDPConn, error) {
+	file := inheritedSocket("udp")
+	if file == nil {
+		return net.ListenUDP("udp", addr)
+	}
+	defer file.Close() // FilePacketConn works on its own copy
+
+	conn, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over UDP socket: %v", err)
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("inherited socket is not a UDP socket")
+	}
+
+	return udpConn, nil
+}
+
+// listenTCPOrInherit is listenUDPOrInherit for the TCP listener.
+func listenTCPOrInherit(addr *net.TCPAddr) (net.Listener, error) {
+	file := inheritedSocket("tcp")
+	if file == nil {
+		return net.ListenTCP("tcp", addr)
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over TCP socket: %v", err)
+	}
+
+	return listener, nil
+}
+
+// listenUnixOrInherit is listenUDPOrInherit for the Unix stream socket.
+func listenUnixOrInherit(path string) (net.Listener, error) {
+	file := inheritedSocket("unix")
+	if file == nil {
+		return listenUnix(path)
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take over Unix socket: %v", err)
+	}
+
+	return listener, nil
+}
+
+// drain waits for the queries being answered to finish, up to drainTimeout.
+func (s *Server) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("Drained, exiting")
+	case <-time.After(drainTimeout):
+		fmt.Println("Gave up waiting for queries in flight, exiting")
+	}
+}
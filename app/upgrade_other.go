@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// watchUpgrade does nothing where sockets can't be handed to a child process, which
+// also lacks the signals that switch the mode.
+func (s *Server) watchUpgrade(udpConn *net.UDPConn, tcpListener net.Listener, unixListener net.Listener) {
+}
@@ -0,0 +1,113 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchUpgrade upgrades the server without dropping queries: on SIGUSR2 it starts the
+// executable again with the same arguments, handing it the listening sockets, then
+// stops reading from them and lets the main loop drain and exit. Both processes share
+// the sockets, so queries keep being answered throughout. The new process must be
+// allowed to outlive this one, which rules out supervisors that stop a service when
+// its main process exits.
+//
+// SIGUSR1 and SIGHUP switch the mode at runtime: SIGUSR1 moves on to the next of
+// normal, local-only and maintenance, and SIGHUP goes straight back to normal. The
+// new process of an upgrade starts in the mode this one was in.
+func (s *Server) watchUpgrade(udpConn *net.UDPConn, tcpListener net.Listener, unixListener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2, syscall.SIGUSR1, syscall.SIGHUP)
+
+	for sig := range signals {
+		switch sig {
+		case syscall.SIGUSR1:
+			s.SetMode((s.currentMode() + 1) % serveMode(len(serveModeNames)))
+			continue
+		case syscall.SIGHUP:
+			s.SetMode(modeNormal)
+			continue
+		}
+
+		pid, err := startUpgrade(udpConn, tcpListener, unixListener, s.currentMode())
+		if err != nil {
+			fmt.Println("Upgrade failed, still serving:", err)
+			continue
+		}
+		fmt.Printf("Handed sockets over to process %d, draining\n", pid)
+
+		s.draining.Store(true)
+		if tcpListener != nil {
+			tcpListener.Close() // open connections are still served until the drain ends
+		}
+		if unixListener, ok := unixListener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(false) // the socket file now belongs to the new process
+			unixListener.Close()
+		}
+		udpConn.SetReadDeadline(time.Now()) // ends the main loop, replies can still be sent
+		return
+	}
+}
+
+// startUpgrade starts the new process with copies of the listening sockets, in the
+// given mode, and returns its PID.
+func startUpgrade(udpConn *net.UDPConn, tcpListener net.Listener, unixListener net.Listener, mode serveMode) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	udpFile, err := udpConn.File()
+	if err != nil {
+		return 0, fmt.Errorf("failed to copy UDP socket: %v", err)
+	}
+	defer udpFile.Close()
+	files := []*os.File{udpFile}
+	sockets := []string{"udp=3"} // ExtraFiles start after stdin, stdout and stderr
+
+	listeners := []struct {
+		name     string
+		listener net.Listener
+	}{{"tcp", tcpListener}, {"unix", unixListener}}
+	for _, socket := range listeners {
+		listener, ok := socket.listener.(interface{ File() (*os.File, error) })
+		if !ok { // not listening on this one
+			continue
+		}
+		file, err := listener.File()
+		if err != nil {
+			return 0, fmt.Errorf("failed to copy %s socket: %v", socket.name, err)
+		}
+		defer file.Close()
+		files = append(files, file)
+		sockets = append(sockets, fmt.Sprintf("%s=%d", socket.name, 3+len(files)-1))
+	}
+
+	env := []string{}
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, inheritEnv+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	args := append(os.Args[1:len(os.Args):len(os.Args)], "--mode="+mode.String()) // the last --mode wins
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(env, inheritEnv+"="+strings.Join(sockets, ","))
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	go cmd.Wait() // reap the new process if this one outlives it
+
+	return cmd.Process.Pid, nil
+}
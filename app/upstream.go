@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	downAfterFailures = 3                // consecutive failures before an upstream is marked down
+	probeInitialWait  = 1 * time.Second  // first probe delay once an upstream is down
+	probeMaxWait      = 60 * time.Second // cap for the exponential probe backoff
+
+	initialTimeout = 1 * time.Second // UDP retransmit timeout before any RTT has been measured
+	minTimeout     = 1 * time.Second // floor for the adaptive retransmit timeout, as in RFC 6298
+)
+
+// Upstream is a resolver queries can be forwarded to, along with its health status.
+// An upstream that keeps failing is marked down and skipped by client queries while
+// a background probe checks it with exponentially increasing intervals.
+type Upstream struct {
+	Addr *net.UDPAddr
+
+	tcp   *tcpPool      // connections used when a UDP answer is truncated
+	slots chan struct{} // one per query in flight to the upstream, nil for no limit
+
+	mu       sync.Mutex
+	failures int  // consecutive failed queries
+	down     bool // skipped by client queries until a probe succeeds
+
+	// TCP-style round-trip estimates (RFC 6298) used to derive the UDP retransmit timeout
+	srtt    time.Duration // smoothed RTT, 0 until the first sample
+	rttvar  time.Duration // RTT variation
+	timeout time.Duration // current retransmit timeout, between minTimeout and upstreamTimeout
+}
+
+// NewUpstream creates an upstream for the given resolver address, initially healthy.
+func NewUpstream(addr *net.UDPAddr) *Upstream {
+	return &Upstream{
+		Addr:    addr,
+		tcp:     &tcpPool{addr: &net.TCPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}, timeout: upstreamTimeout},
+		timeout: initialTimeout,
+	}
+}
+
+// limitOutstanding caps how many queries are forwarded to the upstream at once, so
+// small resolvers aren't overwhelmed. 0 means no limit.
+func (u *Upstream) limitOutstanding(max int) {
+	if max > 0 {
+		u.slots = make(chan struct{}, max)
+	}
+}
+
+// reserve takes a slot for one query, waiting up to wait for one to free up. It
+// reports false if the upstream stayed busy; otherwise unreserve must follow.
+func (u *Upstream) reserve(wait time.Duration) bool {
+	if u.slots == nil {
+		return true
+	}
+
+	select {
+	case u.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case u.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// unreserve frees the slot taken by reserve.
+func (u *Upstream) unreserve() {
+	if u.slots != nil {
+		<-u.slots
+	}
+}
+
+// exchange sends a query to the upstream over UDP and returns its response.
+// If the UDP response is truncated, the query is repeated over a pooled TCP connection.
+// The query is retransmitted on a timer that adapts to the round-trip times measured
+// for this upstream, while answers to any copy are awaited for upstreamTimeout in all.
+func (u *Upstream) exchange(query []byte) ([]byte, error) {
+	start := time.Now()
+	response, retransmitted, err := forwardDNSQuery(query, u.Addr, u.currentTimeout(), upstreamTimeout)
+	if retransmitted {
+		u.backoff()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// An answer after a retransmit may be to either copy, so it says nothing about the RTT (Karn)
+	if !retransmitted {
+		u.recordRTT(time.Since(start))
+	}
+
+	if len(response) >= 4 && messageFlags(response).has(flagTC) {
+		return u.tcp.exchange(query)
+	}
+
+	return response, nil
+}
+
+// currentTimeout returns how long to wait for a UDP response before retransmitting.
+func (u *Upstream) currentTimeout() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.timeout
+}
+
+// recordRTT folds a measured round-trip time into the smoothed estimates and derives
+// the next retransmit timeout as SRTT + 4*RTTVAR, clamped to [minTimeout, upstreamTimeout].
+func (u *Upstream) recordRTT(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.srtt == 0 {
+		u.srtt = rtt
+		u.rttvar = rtt / 2
+	} else {
+		delta := u.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		u.rttvar = (3*u.rttvar + delta) / 4
+		u.srtt = (7*u.srtt + rtt) / 8
+	}
+
+	u.timeout = min(max(u.srtt+4*u.rttvar, minTimeout), upstreamTimeout)
+}
+
+// backoff doubles the retransmit timeout after it expired, as the estimate was too optimistic.
+func (u *Upstream) backoff() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.timeout = min(2*u.timeout, upstreamTimeout)
+}
+
+// isDown reports whether the upstream is currently marked down.
+func (u *Upstream) isDown() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.down
+}
+
+// recordSuccess clears the failure count after the upstream answered a query.
+func (u *Upstream) recordSuccess() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures = 0
+}
+
+// recordFailure counts a failed query and marks the upstream down once it has failed
+// downAfterFailures times in a row, starting the background probe.
+func (u *Upstream) recordFailure() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures++
+	if u.down || u.failures < downAfterFailures {
+		return
+	}
+
+	u.markDown(fmt.Sprintf("after %d failures", u.failures))
+}
+
+// recordUnreachable marks the upstream down right away after an ICMP port or host
+// unreachable error, which means nothing is listening there and waiting would not help.
+func (u *Upstream) recordUnreachable() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.failures++
+	if !u.down {
+		u.markDown("after ICMP unreachable")
+	}
+}
+
+// markDown marks the upstream down and starts probing it. The caller must hold u.mu.
+func (u *Upstream) markDown(reason string) {
+	u.down = true
+	fmt.Printf("Resolver %s marked down %s\n", u.Addr, reason)
+	go u.probe()
+}
+
+// isUnreachable reports whether a query failed because the kernel received an ICMP
+// unreachable for it, which connected UDP sockets surface as a refused connection.
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
+}
+
+// probe queries a down upstream with exponential backoff until it answers again,
+// then marks it healthy.
+func (u *Upstream) probe() {
+	wait := probeInitialWait
+	for id := uint16(1); ; id++ {
+		time.Sleep(wait)
+
+		if _, err := u.exchange(buildQuery(id, ".")); err == nil {
+			u.mu.Lock()
+			u.down = false
+			u.failures = 0
+			u.mu.Unlock()
+			fmt.Printf("Resolver %s is back up\n", u.Addr)
+			return
+		}
+
+		wait *= 2
+		if wait > probeMaxWait {
+			wait = probeMaxWait
+		}
+	}
+}
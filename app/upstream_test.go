@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPUpstream answers the queries sent to a loopback port until the test ends.
+// answer returns how long to wait before replying and the datagrams to reply with,
+// none for a query that goes unanswered. Each query is answered on its own, so a
+// slow answer doesn't hold back the ones after it.
+func startUDPUpstream(t *testing.T, answer func(query []byte) (time.Duration, [][]byte)) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			size, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			delay, replies := answer(append([]byte{}, buf[:size]...))
+			go func() {
+				time.Sleep(delay)
+				for _, reply := range replies {
+					conn.WriteToUDP(reply, addr)
+				}
+			}()
+		}
+	}()
+
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// testQuery builds a query for name A with the given ID.
+func testQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+
+	query, err := (&DNSMessage{Header: DNSHeader{ID: id, RD: 1}, Questions: []DNSQuestion{{Name: name, Type: typeA, Class: classIN}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return query
+}
+
+// reply turns a query into an empty response to it.
+func reply(query []byte) []byte {
+	response := append([]byte{}, query...)
+	response[2] |= 0x80 // QR
+
+	return response
+}
+
+func TestForwardDNSQueryRetransmits(t *testing.T) {
+	tests := []struct {
+		name              string
+		ignore            int           // copies of the query the upstream doesn't answer
+		delay             time.Duration // how long each answer takes
+		wantRetransmitted bool
+		wantErr           bool
+	}{
+		{name: "answered in time", delay: 0},
+		{name: "answered after the timer", delay: 150 * time.Millisecond, wantRetransmitted: true},
+		{name: "first copy lost", ignore: 1, wantRetransmitted: true},
+		{name: "no answer", ignore: 100, wantRetransmitted: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := 0
+			addr := startUDPUpstream(t, func(query []byte) (time.Duration, [][]byte) {
+				if received++; received <= tt.ignore {
+					return 0, nil
+				}
+				return tt.delay, [][]byte{reply(query)}
+			})
+
+			query := testQuery(t, 1, "a.lan")
+			response, retransmitted, err := forwardDNSQuery(query, addr, 50*time.Millisecond, 500*time.Millisecond)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got response %x, want an error", response)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if retransmitted != tt.wantRetransmitted {
+				t.Errorf("got retransmitted %v, want %v", retransmitted, tt.wantRetransmitted)
+			}
+		})
+	}
+}
+
+// TestUpstreamFastThenSlow checks that an upstream answering from its cache in a
+// millisecond and a miss in 300ms gets the slow answer too, without it counting
+// against the upstream.
+func TestUpstreamFastThenSlow(t *testing.T) {
+	addr := startUDPUpstream(t, func(query []byte) (time.Duration, [][]byte) {
+		var msg DNSMessage
+		if err := msg.Unmarshal(query); err == nil && msg.Questions[0].Name == "miss.lan" {
+			return 300 * time.Millisecond, [][]byte{reply(query)}
+		}
+		return time.Millisecond, [][]byte{reply(query)}
+	})
+	f := &Forwarder{Upstreams: []*Upstream{NewUpstream(addr)}}
+
+	for id := uint16(1); id <= 30; id++ {
+		query := testQuery(t, id, "hit.lan")
+		if _, err := f.resolve(query, len(query)); err != nil {
+			t.Fatalf("cached query %d: %v", id, err)
+		}
+	}
+
+	for id := uint16(100); id < 100+downAfterFailures; id++ {
+		query := testQuery(t, id, "miss.lan")
+		if _, err := f.resolve(query, len(query)); err != nil {
+			t.Fatalf("uncached query: %v", err)
+		}
+	}
+
+	upstream := f.Upstreams[0]
+	if upstream.failures != 0 || upstream.isDown() {
+		t.Errorf("upstream has %d failures and down %v, want none and up", upstream.failures, upstream.isDown())
+	}
+	if timeout := upstream.currentTimeout(); timeout < minTimeout {
+		t.Errorf("retransmit timeout %v is below the floor of %v", timeout, minTimeout)
+	}
+}
@@ -2,18 +2,26 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"time"
 )
 
+// upstreamTimeout is the longest we wait for a resolver to answer a forwarded query.
+const upstreamTimeout = 5 * time.Second
+
+// maxMessageSize is the largest DNS message that fits in a UDP datagram or a TCP length prefix.
+const maxMessageSize = 65535
+
 // toBytes serializes the DNSHeader into a 12-byte array in network byte order.
 // This function is used to convert the DNSHeader struct into a byte slice for transmission over a network.
 func (header *DNSHeader) toBytes() []byte {
 	buffer := make([]byte, 12) // DNS header = 12 bytes
 
 	binary.BigEndian.PutUint16(buffer[0:2], header.ID) // encode the header.ID
-	binary.BigEndian.PutUint16(buffer[2:4], (header.QR<<15)|(header.OPCODE<<11)|(header.AA<<10)|(header.TC<<9)|(header.RD<<8)|(header.RA<<7)|(header.Z<<4)|(header.RCODE))
+	binary.BigEndian.PutUint16(buffer[2:4], (header.QR<<15)|(uint16(header.OPCODE)<<11)|(header.AA<<10)|(header.TC<<9)|(header.RD<<8)|(header.RA<<7)|(header.Z<<4)|uint16(header.RCODE&0x0F))
 	binary.BigEndian.PutUint16(buffer[4:6], header.QDCOUNT)
 	binary.BigEndian.PutUint16(buffer[6:8], header.ANCOUNT)
 	binary.BigEndian.PutUint16(buffer[8:10], header.NSCOUNT)
@@ -27,6 +35,13 @@ func (header *DNSHeader) toBytes() []byte {
 // The result is terminated with a null byte (0x00).
 func encodeDomainName(domain string) []byte {
 	encoded := []byte{}
+
+	// The root name is just the null byte
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return []byte{0x00}
+	}
+
 	labels := strings.Split(domain, ".")
 	for _, label := range labels {
 		encoded = append(encoded, byte(len(label)))
@@ -39,13 +54,29 @@ func encodeDomainName(domain string) []byte {
 	return encoded
 }
 
+// splitList splits a comma-separated flag value, trimming spaces and ignoring empty entries.
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
 // parseDNSHeader decodes a 12-byte slice into a DNSHeader struct.
 // This function extracts all fields from the DNS header, including flags and counts.
 func parseDNSHeader(buf []byte) DNSHeader {
-	id := binary.BigEndian.Uint16(buf[0:2])    // id field
-	flags := binary.BigEndian.Uint16(buf[2:4]) // flags
-	opcode := (flags >> 11) & 0x0F             // opcode field
-	rd := (flags >> 8) & 0x01                  // RG flag
+	id := binary.BigEndian.Uint16(buf[0:2]) // id field
+	flags := messageFlags(buf)              // flags
+	opcode := flags.opcode()                // opcode field
+	rd := uint16(0)                         // RD flag
+	if flags.has(flagRD) {
+		rd = 1
+	}
 
 	// Extract counts of questions, authority records, and additional records
 	qdcount := binary.BigEndian.Uint16(buf[4:6])
@@ -55,23 +86,23 @@ func parseDNSHeader(buf []byte) DNSHeader {
 	// Construct the DNSHeader struct with decoded values
 	header := DNSHeader{
 		ID:      id,
-		QR:      1,      // Set QR to 1 for response
-		OPCODE:  opcode, // Mimic OPCODE
-		AA:      0,      // Not authoritative
-		TC:      0,      // Not truncated
-		RD:      rd,     // Mimic RD
-		RA:      0,      // Recursion not available
-		Z:       0,      // Reserved
-		RCODE:   0,      // No error if standard query; else 4
+		QR:      1,            // Set QR to 1 for response
+		OPCODE:  opcode,       // Mimic OPCODE
+		AA:      0,            // Not authoritative
+		TC:      0,            // Not truncated
+		RD:      rd,           // Mimic RD
+		RA:      0,            // Recursion not available
+		Z:       0,            // Reserved
+		RCODE:   rcodeNoError, // No error if standard query; else NOTIMP
 		QDCOUNT: qdcount,
 		ANCOUNT: 0, // Will be set dynamically
 		NSCOUNT: nscount,
 		ARCOUNT: arcount,
 	}
 
-	// If not a standard query, set the RCODE to 4 (Not Implemented)
-	if opcode != 0 { // If not a standard query, set RCODE to 4
-		header.RCODE = 4
+	// If not a standard query, set the RCODE to NOTIMP
+	if opcode != opcodeQuery {
+		header.RCODE = rcodeNotImp
 	}
 
 	return header
@@ -79,13 +110,20 @@ func parseDNSHeader(buf []byte) DNSHeader {
 
 // parseQuestions parses the DNS questions from a query packet starting from a given offset.
 // It returns a slice of DNSQuestion structs and the new offset after parsing.
-func parseQuestions(buf []byte, offset int, count int) ([]DNSQuestion, int) {
+// An error is returned if the message ends before the announced questions do.
+func parseQuestions(buf []byte, offset int, count int) ([]DNSQuestion, int, error) {
 	questions := []DNSQuestion{}
 
 	for i := 0; i < count; i++ {
-		qname, newOffset := parseDomainName(buf, offset)
-		qtype := buf[newOffset : newOffset+2]
-		qclass := buf[newOffset+2 : newOffset+4]
+		qname, newOffset, err := parseDomainName(buf, offset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("question %d: %v", i+1, err)
+		}
+		if newOffset+4 > len(buf) {
+			return nil, 0, fmt.Errorf("question %d: type and class run past end of message", i+1)
+		}
+		qtype := QType(binary.BigEndian.Uint16(buf[newOffset : newOffset+2]))
+		qclass := QClass(binary.BigEndian.Uint16(buf[newOffset+2 : newOffset+4]))
 		offset = newOffset + 4
 
 		questions = append(questions, DNSQuestion{
@@ -95,21 +133,41 @@ func parseQuestions(buf []byte, offset int, count int) ([]DNSQuestion, int) {
 		})
 	}
 
-	return questions, offset
+	return questions, offset, nil
 }
 
-func parseDomainName(buf []byte, offset int) (string, int) {
+// parseDomainName decodes the possibly compressed name at offset and returns it with
+// the offset just past it. An error is returned if a label or pointer runs past the end
+// of buf, if a pointer doesn't point back to an earlier part of the message, which also
+// rules out pointer loops, if a label has a reserved type or if the name is longer than
+// 255 bytes.
+func parseDomainName(buf []byte, offset int) (string, int, error) {
 	labels := []string{}
+	end := -1       // where the name ends at its original position, once a pointer is followed
+	limit := offset // pointers must point before this, the start of the labels read last
+	size := 1       // length of the uncompressed name, counting the root label
 	for {
+		if offset >= len(buf) {
+			return "", 0, fmt.Errorf("name at offset %d runs past end of message", offset)
+		}
 		length := int(buf[offset])
 
-		// Check if the label is a pointer
-		if length&0xC0 == 0xC0 {
+		switch length & 0xC0 {
+		case 0xC0: // a pointer to the rest of the name
+			if offset+2 > len(buf) {
+				return "", 0, fmt.Errorf("compression pointer at offset %d runs past end of message", offset)
+			}
 			pointer := int(binary.BigEndian.Uint16(buf[offset:offset+2]) & 0x3FFF)
-			label, _ := parseDomainName(buf, pointer)
-			labels = append(labels, label)
-			offset += 2
-			break
+			if pointer >= limit {
+				return "", 0, fmt.Errorf("compression pointer at offset %d points to %d instead of back into the message", offset, pointer)
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset, limit = pointer, pointer
+			continue
+		case 0x40, 0x80:
+			return "", 0, fmt.Errorf("label at offset %d has reserved type 0x%02X", offset, length&0xC0)
 		}
 
 		// Zero length means end of the name
@@ -118,68 +176,564 @@ func parseDomainName(buf []byte, offset int) (string, int) {
 			break
 		}
 
+		size += 1 + length
+		if size > 255 {
+			return "", 0, fmt.Errorf("name at offset %d is longer than 255 bytes", offset)
+		}
 		offset++
+		if offset+length > len(buf) {
+			return "", 0, fmt.Errorf("label at offset %d runs past end of message", offset-1)
+		}
 		labels = append(labels, string(buf[offset:offset+length]))
 		offset += length
 	}
-	return strings.Join(labels, "."), offset
+	if end < 0 {
+		end = offset
+	}
+
+	return strings.Join(labels, "."), end, nil
+}
+
+// skipRecord returns the offset just past the resource record starting at offset.
+// An error is returned if the record runs past the end of buf.
+func skipRecord(buf []byte, offset int) (int, error) {
+	_, offset, err := parseDomainName(buf, offset)
+	if err != nil {
+		return 0, err
+	}
+	if offset+10 > len(buf) {
+		return 0, fmt.Errorf("record at offset %d runs past end of message", offset)
+	}
+	end := offset + 10 + int(binary.BigEndian.Uint16(buf[offset+8:offset+10]))
+	if end > len(buf) {
+		return 0, fmt.Errorf("record data at offset %d runs past end of message", offset+10)
+	}
+
+	return end, nil
+}
+
+// validateMessage checks that the header, questions and records a message announces
+// all fit within it, so later passes over the message can't run off its end.
+func validateMessage(buf []byte) error {
+	if len(buf) < 12 {
+		return fmt.Errorf("message is %d bytes, shorter than a header", len(buf))
+	}
+
+	_, offset, err := parseQuestions(buf, 12, int(binary.BigEndian.Uint16(buf[4:6])))
+	if err != nil {
+		return err
+	}
+
+	count := int(binary.BigEndian.Uint16(buf[6:8])) + // ANCOUNT
+		int(binary.BigEndian.Uint16(buf[8:10])) + // NSCOUNT
+		int(binary.BigEndian.Uint16(buf[10:12])) // ARCOUNT
+	for i := 0; i < count; i++ {
+		offset, err = skipRecord(buf, offset)
+		if err != nil {
+			return fmt.Errorf("record %d: %v", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// findOPT locates the OPT pseudo-record in the additional section of a message, given the
+// offset just past its question section. It returns the record's start and end offsets, or -1, -1.
+// A malformed record section is treated as having no OPT record.
+func findOPT(buf []byte, offset int) (int, int) {
+	ancount := int(binary.BigEndian.Uint16(buf[6:8]))
+	nscount := int(binary.BigEndian.Uint16(buf[8:10]))
+	arcount := int(binary.BigEndian.Uint16(buf[10:12]))
+
+	var err error
+	for i := 0; i < ancount+nscount; i++ {
+		if offset, err = skipRecord(buf, offset); err != nil {
+			return -1, -1
+		}
+	}
+
+	for i := 0; i < arcount; i++ {
+		start := offset
+		_, typeOffset, err := parseDomainName(buf, offset)
+		if err != nil {
+			return -1, -1
+		}
+		if offset, err = skipRecord(buf, offset); err != nil {
+			return -1, -1
+		}
+		if QType(binary.BigEndian.Uint16(buf[typeOffset:typeOffset+2])) == typeOPT {
+			return start, offset
+		}
+	}
+
+	return -1, -1
+}
+
+// withEDNS builds the query to forward upstream: the header and questions of the original
+// query followed by a single OPT record advertising the given UDP payload size.
+// If the client sent its own OPT record, its flags are kept with the size replaced, and its
+// options go through the options policy.
+func withEDNS(query []byte, offset int, size uint16, options *EDNSOptionPolicy) []byte {
+	opt := []byte{0x00, 0x00, byte(typeOPT), 0, 0, 0, 0, 0, 0, 0, 0} // root name, TYPE OPT, CLASS, TTL, RDLENGTH
+	if start, end := findOPT(query, offset); start >= 0 {
+		_, typeOffset, _ := parseDomainName(query, start) // findOPT parsed it already
+		rdata := options.apply(query[typeOffset+10 : end])
+		opt = append(opt[:5], query[typeOffset+4:typeOffset+8]...) // the client's extended RCODE, version and flags
+		opt = binary.BigEndian.AppendUint16(opt, uint16(len(rdata)))
+		opt = append(opt, rdata...)
+	}
+	binary.BigEndian.PutUint16(opt[3:5], size) // CLASS carries the requestor's payload size
+
+	forwarded := make([]byte, offset, offset+len(opt))
+	copy(forwarded, query[:offset])
+	binary.BigEndian.PutUint16(forwarded[6:8], 0)   // ANCOUNT
+	binary.BigEndian.PutUint16(forwarded[8:10], 0)  // NSCOUNT
+	binary.BigEndian.PutUint16(forwarded[10:12], 1) // ARCOUNT, our OPT only
+
+	return append(forwarded, opt...)
+}
+
+// stripOPT removes the OPT record from a response, for clients that did not ask for EDNS.
+func stripOPT(response []byte) []byte {
+	if len(response) < 12 {
+		return response
+	}
+
+	_, offset, err := parseQuestions(response, 12, int(binary.BigEndian.Uint16(response[4:6])))
+	if err != nil {
+		return response
+	}
+	start, end := findOPT(response, offset)
+	if start < 0 {
+		return response
+	}
+
+	stripped := append(append([]byte{}, response[:start]...), response[end:]...)
+	binary.BigEndian.PutUint16(stripped[10:12], binary.BigEndian.Uint16(stripped[10:12])-1)
+
+	return stripped
+}
+
+// buildEmptyResponse answers a query with the given RCODE and only its question section echoed.
+func buildEmptyResponse(query []byte, offset int, header DNSHeader, rcode RCode) []byte {
+	header.RCODE = rcode
+	header.ANCOUNT = 0
+	header.NSCOUNT = 0
+	header.ARCOUNT = 0
+
+	return append(header.toBytes(), query[12:offset]...)
+}
+
+// buildAnswerResponse answers a query with the given answer records and its question
+// section echoed. Names in the records are compressed against the questions and each
+// other. Records that can't be encoded turn the answer into SERVFAIL.
+func buildAnswerResponse(query []byte, offset int, header DNSHeader, records []ResourceRecord) []byte {
+	return buildResponse(query, offset, header, rcodeNoError, records, nil)
+}
+
+// buildResponse is buildAnswerResponse with an RCODE and authority records, such as
+// the SOA of a negative answer (RFC 2308 section 3).
+func buildResponse(query []byte, offset int, header DNSHeader, rcode RCode, answers []ResourceRecord, authority []ResourceRecord) []byte {
+	response := buildEmptyResponse(query, offset, header, rcode)
+
+	names := newCompressor()
+	for next := 12; next < offset; {
+		names.remember(response, next)
+		_, end, err := parseDomainName(response, next)
+		if err != nil {
+			break
+		}
+		next = end + 4 // skip the question's type and class
+	}
+
+	for _, record := range append(append([]ResourceRecord{}, answers...), authority...) {
+		var err error
+		response, err = record.appendTo(response, names)
+		if err != nil {
+			fmt.Printf("Failed to encode answer for %s: %v\n", logName(record.Name), err)
+			return buildEmptyResponse(query, offset, header, rcodeServFail)
+		}
+	}
+	binary.BigEndian.PutUint16(response[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(response[8:10], uint16(len(authority)))
+
+	return response
 }
 
 // forwardDNSQuery sends a DNS query to the specified resolver and returns the response.
 // It handles communication over UDP and includes error handling for network issues.
-func forwardDNSQuery(query []byte, resolverAddr *net.UDPAddr) ([]byte, error) {
+// A truncated response (TC=1) is returned as is; Upstream.exchange retries those over TCP.
+// Responses that don't match the query's ID and question section are discarded.
+// The query is sent again each time retransmit passes without an answer, the interval
+// doubling each time, and an answer to any copy is taken until timeout covers the whole
+// exchange. It also reports whether the query was retransmitted.
+func forwardDNSQuery(query []byte, resolverAddr *net.UDPAddr, retransmit, timeout time.Duration) ([]byte, bool, error) {
 	conn, err := net.DialUDP("udp", nil, resolverAddr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial resolver: %v", err)
+		return nil, false, fmt.Errorf("failed to dial resolver: %v", err)
 	}
 	defer conn.Close()
 
+	deadline := time.Now().Add(timeout)
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return nil, false, fmt.Errorf("failed to set resolver deadline: %v", err)
+	}
+
 	_, err = conn.Write(query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send query to resolver: %v", err)
+		return nil, false, fmt.Errorf("failed to send query to resolver: %w", err)
 	}
 
-	response := make([]byte, 512)
-	_, _, err = conn.ReadFromUDP(response)
+	// Keep reading until a response that echoes our query arrives, discarding anything else
+	response := make([]byte, maxMessageSize)
+	retransmitted := false
+	next := time.Now().Add(retransmit)
+	for {
+		readDeadline := next
+		if deadline.Before(next) {
+			readDeadline = deadline
+		}
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return nil, retransmitted, fmt.Errorf("failed to set resolver deadline: %v", err)
+		}
+		size, _, err := conn.ReadFromUDP(response)
+		var netErr net.Error
+		if err != nil && errors.As(err, &netErr) && netErr.Timeout() && next.Before(deadline) {
+			if _, err := conn.Write(query); err != nil {
+				return nil, true, fmt.Errorf("failed to send query to resolver: %w", err)
+			}
+			retransmitted = true
+			retransmit *= 2
+			next = time.Now().Add(retransmit)
+			continue
+		}
+		if err != nil {
+			return nil, retransmitted, fmt.Errorf("failed to receive response from resolver: %w", err)
+		}
+
+		if matchesQuery(query, response[:size]) {
+			return response[:size], retransmitted, nil
+		}
+		fmt.Printf("Discarding response from %s that does not match the query\n", resolverAddr)
+	}
+}
+
+// matchesQuery reports whether a response belongs to a query: it must be a well-formed
+// response with the same ID and echo the same questions, with names compared case-insensitively.
+func matchesQuery(query []byte, response []byte) bool {
+	if validateMessage(response) != nil || !messageFlags(response).has(flagQR) {
+		return false
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != binary.BigEndian.Uint16(query[0:2]) {
+		return false
+	}
+
+	qdcount := binary.BigEndian.Uint16(query[4:6])
+	if binary.BigEndian.Uint16(response[4:6]) != qdcount {
+		return false
+	}
+
+	sent, _, err := parseQuestions(query, 12, int(qdcount))
 	if err != nil {
-		return nil, fmt.Errorf("failed to receive response from resolver: %v", err)
+		return false
+	}
+	echoed, _, _ := parseQuestions(response, 12, int(qdcount)) // validated above
+	for i := range sent {
+		if canonicalName(sent[i].Name) != canonicalName(echoed[i].Name) ||
+			sent[i].Type != echoed[i].Type ||
+			sent[i].Class != echoed[i].Class {
+			return false
+		}
 	}
 
-	return response, nil
+	return true
 }
 
-// handleQuery processes incoming DNS queries, forwards them to a specified resolver,
+// handleQuery processes incoming DNS queries, forwards them to the configured resolvers,
 // and returns the response to the original requester.
 // It handles single and multiple questions by splitting and combining responses as needed.
-func handleQuery(query []byte, resolverAddr *net.UDPAddr, udpConn *net.UDPConn, source *net.UDPAddr) {
+// Queries for a QTYPE filtered by the policy, for one of the server's own names, for a
+// name in the local records file, or for a .local name when the mDNS bridge is enabled
+// are answered without the resolvers.
+// Queries cut short, with sections that run past their end or without a question get
+// FORMERR.
+func (s *Server) handleQuery(req *RequestContext, query []byte) {
+	traceMessage("Query from", req.ClientAddr, query)
+
+	// Without a full header there is no ID to answer with
+	if len(query) < 12 {
+		fmt.Printf("Dropping %d-byte query from %s\n", len(query), req.ClientAddr)
+		return
+	}
+
 	// Parse the DNS header
 	header := parseDNSHeader(query[:12])
 
+	// Reject queries whose sections run past the end of the packet
+	if err := validateMessage(query); err != nil {
+		fmt.Printf("Malformed query from %s: %v\n", req.ClientAddr, err)
+		header.QDCOUNT = 0
+		err = req.respond(buildEmptyResponse(query, 12, header, rcodeFormErr))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+
 	// Parse questions
-	questions, offset := parseQuestions(query, 12, int(header.QDCOUNT))
+	questions, offset, _ := parseQuestions(query, 12, int(header.QDCOUNT)) // validated above
+
+	// Read the client's OPT record, rejecting queries that repeat or misplace it
+	var message DNSMessage
+	if err := message.Unmarshal(query); err != nil {
+		fmt.Printf("Malformed query from %s: %v\n", req.ClientAddr, err)
+		err = req.respond(buildEmptyResponse(query, offset, header, rcodeFormErr))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+	if edns, ok := message.EDNS(); ok {
+		req.EDNS = &edns
+	}
+
+	// Only EDNS version 0 exists; anything newer gets BADVERS (RFC 6891 section 6.1.3)
+	if req.EDNS != nil && req.EDNS.Version > 0 {
+		response := buildEmptyResponse(query, offset, header, rcodeBadVers)
+		err := req.respond(appendOPT(response, EDNS{ExtendedRCode: uint8(rcodeBadVers >> 4), DO: req.EDNS.DO}))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+
+	// A query without a question has nothing to answer or forward, even with an OPT record
+	if len(questions) == 0 {
+		fmt.Printf("Query without a question from %s\n", req.ClientAddr)
+		err := req.respond(buildEmptyResponse(query, offset, header, rcodeFormErr))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+
+	// Answer nothing for real while under maintenance
+	if s.currentMode() == modeMaintenance {
+		response := buildEmptyResponse(query, offset, header, rcodeServFail)
+		err := req.respond(withEDE(response, query, offset, edeOther, "server under maintenance"))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+
+	// Let plugins look at the query, change it or answer it themselves
+	changed, answer, err := runQueryPlugins(req, query, &message)
+	if err != nil {
+		fmt.Println(err)
+		err = req.respond(buildEmptyResponse(query, offset, header, rcodeServFail))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+	if answer != nil {
+		err := req.respond(answer)
+		if err != nil {
+			fmt.Println("Failed to send plugin response:", err)
+		}
+		return
+	}
+	if len(plugins) > 0 {
+		query = changed
+		header = parseDNSHeader(query[:12])
+		questions, offset, _ = parseQuestions(query, 12, int(header.QDCOUNT)) // encoded by Marshal
+	}
+
+	// Refuse classes we can't serve rather than treating everything as IN
+	for _, question := range questions {
+		if !isSupportedClass(question.Class) {
+			err := req.respond(buildEmptyResponse(query, offset, header, rcodeNotImp))
+			if err != nil {
+				fmt.Println("Failed to send response:", err)
+			}
+			return
+		}
+	}
+
+	// Answer CH-class built-ins such as version.bind locally; other CH names are refused
+	if len(questions) == 1 && questions[0].Class == classCH {
+		response := buildEmptyResponse(query, offset, header, rcodeRefused)
+		if records, ok := chaosAnswer(questions[0]); ok {
+			header.AA = 1
+			response = buildAnswerResponse(query, offset, header, records)
+		}
+
+		err := req.respond(response)
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
+
+	// Identify the client device for per-device policy
+	if s.IdentifyDevices {
+		req.DeviceID = identifyDevice(query, req.clientIP(), s.MACSources)
+	}
+
+	// Answer filtered query types without asking the resolvers
+	if action := s.Policy.action(req, questions); action != qtypeAllow {
+		rcode := rcodeNoError // with no answers
+		if action == qtypeRefuse {
+			rcode = rcodeRefused
+		}
+
+		err := req.respond(buildEmptyResponse(query, offset, header, rcode))
+		if err != nil {
+			fmt.Println("Failed to send filtered response:", err)
+		}
+		return
+	}
+
+	// Keep browsers on the local policy instead of their built-in DoH
+	if s.DoHCanary && len(questions) == 1 && isDoHCanary(questions[0]) {
+		err := req.respond(buildEmptyResponse(query, offset, header, rcodeNXDomain))
+		if err != nil {
+			fmt.Println("Failed to send canary response:", err)
+		}
+		return
+	}
+
+	// Answer the server's own hostnames from the interface addresses
+	if len(questions) == 1 {
+		if records, ok := s.SelfNames.answer(questions[0]); ok {
+			header.AA = 1
+			response := buildAnswerResponse(query, offset, header, records)
+
+			err := req.respond(response)
+			if err != nil {
+				fmt.Println("Failed to send local response:", err)
+			}
+			return
+		}
+	}
+
+	// Answer names defined in the local records file
+	if len(questions) == 1 {
+		if records, ok := s.Records.answer(questions[0]); ok {
+			// Finish a chain that leaves the local data through the resolvers, taking their
+			// RCODE and authority so a target that doesn't exist isn't answered NOERROR
+			rcode := rcodeNoError
+			var authority []ResourceRecord
+			if target, ok := aliasTarget(records, questions[0]); ok && !s.Records.has(target) && s.currentMode() == modeNormal {
+				var answers []ResourceRecord
+				rcode, answers, authority = s.resolveAlias(header.ID, target, questions[0])
+				records = append(records, answers...)
+			}
+
+			// Tell caches how long the lack of records holds, when the zone is known
+			if soa, ok := s.Records.zoneSOA(questions[0]); ok && len(records) == 0 {
+				authority = append(authority, soa)
+			}
+
+			// Local and relayed parts of a chain share its lowest TTL; relayed ones are capped already
+			header.AA = 1
+			response := buildResponse(query, offset, header, rcode, records, authority)
+			normalizeTTLs(response, 0)
+
+			err := req.respond(response)
+			if err != nil {
+				fmt.Println("Failed to send local response:", err)
+			}
+			return
+		}
+	}
+
+	// Answer names that spell out an IP address under the configured zones
+	if len(questions) == 1 {
+		if records, ok := s.IPNames.answer(questions[0]); ok {
+			header.AA = 1
+			response := buildAnswerResponse(query, offset, header, records)
+
+			err := req.respond(response)
+			if err != nil {
+				fmt.Println("Failed to send local response:", err)
+			}
+			return
+		}
+	}
+
+	// Bridge .local names to multicast DNS instead of leaking them to the resolvers
+	if s.MDNSBridge && len(questions) == 1 && isMDNSName(questions[0].Name) && questions[0].Class == classIN {
+		records, err := queryMDNS(questions[0])
+		if err != nil {
+			fmt.Printf("mDNS bridge for %s: %v\n", logName(questions[0].Name), err)
+		}
+
+		// Nobody answering is left to a local zone's negative answer, if there is one.
+		// Otherwise it is SERVFAIL, as mDNS can't tell a name that doesn't exist from a
+		// device that is off
+		if _, inZone := s.Records.zoneSOA(questions[0]); err == nil || !inZone {
+			response := buildEmptyResponse(query, offset, header, rcodeServFail)
+			if err == nil {
+				response = buildAnswerResponse(query, offset, header, records) // NODATA if none are of the type
+			}
+
+			err = req.respond(response)
+			if err != nil {
+				fmt.Println("Failed to send mDNS response:", err)
+			}
+			return
+		}
+	}
+
+	// Names in a zone with a local SOA that no local source answered don't exist, unless
+	// names below them do
+	if len(questions) == 1 {
+		if soa, ok := s.Records.zoneSOA(questions[0]); ok {
+			rcode := rcodeNXDomain
+			if s.Records.isNonTerminal(questions[0].Name) {
+				rcode = rcodeNoError // NODATA for an empty non-terminal
+			}
+
+			header.AA = 1
+			response := buildResponse(query, offset, header, rcode, nil, []ResourceRecord{soa})
+
+			err := req.respond(response)
+			if err != nil {
+				fmt.Println("Failed to send local response:", err)
+			}
+			return
+		}
+	}
+
+	// Keep to local data while the resolvers are off limits
+	if s.currentMode() == modeLocalOnly {
+		response := buildEmptyResponse(query, offset, header, rcodeRefused)
+		err := req.respond(withEDE(response, query, offset, edeNotAuthoritative, "local-only mode"))
+		if err != nil {
+			fmt.Println("Failed to send response:", err)
+		}
+		return
+	}
 
 	if len(questions) > 1 {
 		// Forward each question separately
 		var responses [][]byte
 		for i := 0; i < len(questions); i++ {
 			// Create a DNS query for each question
-			queryPart := query[:12]
-			queryPart = append(queryPart, encodeDomainName(questions[i].Name)...)
-			queryPart = append(queryPart, questions[i].Type...)
-			queryPart = append(queryPart, questions[i].Class...)
-
-			// Append the rest of the query (if applicable)
-			if offset < len(query) {
-				queryPart = append(queryPart, query[offset:]...)
-			}
+			queryPart := append([]byte{}, query[:12]...)
+			binary.BigEndian.PutUint16(queryPart[4:6], 1) // one question per forwarded query
+			queryPart = append(queryPart, questions[i].toBytes()...)
 
-			// Forward the query to the resolver
-			response, err := forwardDNSQuery(queryPart, resolverAddr)
+			// Forward the query to the resolvers
+			response, err := s.Forwarder.resolve(queryPart, len(queryPart))
 			if err != nil {
 				fmt.Println("Failed to forward query:", err)
 				continue
 			}
-			responses = append(responses, response)
+			normalizeTTLs(response, s.MaxTTL)
+			responses = append(responses, stripOPT(response))
 		}
 
 		// Combine responses
@@ -196,22 +750,30 @@ func handleQuery(query []byte, resolverAddr *net.UDPAddr, udpConn *net.UDPConn,
 		combinedResponse = append(combinedResponseHeader, combinedResponse...)
 
 		// Send the combined response back to the client
-		_, err := udpConn.WriteToUDP(combinedResponse, source)
+		err := req.respond(combinedResponse)
 		if err != nil {
 			fmt.Println("Failed to send combined response:", err)
 		}
 		return
 	}
 
-	// Forward the query to the resolver
-	response, err := forwardDNSQuery(query[:offset], resolverAddr)
+	// Forward the query to the resolvers, and a sample of queries to the mirror
+	response, err := s.Forwarder.resolve(query, offset)
+	s.Mirror.copy(query, response)
 	if err != nil {
 		fmt.Println("Failed to forward query:", err)
 		return
 	}
 
+	normalizeTTLs(response, s.MaxTTL)
+
+	// Don't hand an OPT record to a client that never sent one
+	if req.EDNS == nil {
+		response = stripOPT(response)
+	}
+
 	// Send the resolver's response back to the client
-	_, err = udpConn.WriteToUDP(response, source)
+	err = req.respond(response)
 	if err != nil {
 		fmt.Println("Failed to send response:", err)
 	}
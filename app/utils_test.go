@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDomainName(t *testing.T) {
+	// example.com at 0, then www. with a pointer back to it at 13
+	compressed := "\x07example\x03com\x00\x03www\xc0\x00"
+
+	tests := []struct {
+		name    string
+		msg     string
+		offset  int
+		want    string
+		wantEnd int
+		wantErr bool
+	}{
+		{name: "plain", msg: "\x03www\x07example\x03com\x00", want: "www.example.com", wantEnd: 17},
+		{name: "root", msg: "\x00", want: "", wantEnd: 1},
+		{name: "pointer", msg: compressed, offset: 13, want: "www.example.com", wantEnd: 19},
+		{name: "pointer at the start", msg: compressed + "\xc0\x0d", offset: 19, want: "www.example.com", wantEnd: 21},
+		{name: "case kept", msg: "\x03WwW\x00", want: "WwW", wantEnd: 5},
+		{name: "pointer to itself", msg: "\xc0\x00", wantErr: true},
+		{name: "pointer loop", msg: "\x01a\xc0\x04\xc0\x00", offset: 4, wantErr: true},
+		{name: "forward pointer", msg: "\xc0\x02\x00", wantErr: true},
+		{name: "pointer cut short", msg: "\x01a\xc0", wantErr: true},
+		{name: "label over 63 octets", msg: "\x40" + strings.Repeat("a", 64) + "\x00", wantErr: true},
+		{name: "reserved label type", msg: "\x80\x00", wantErr: true},
+		{name: "label past the end", msg: "\x05ab", wantErr: true},
+		{name: "no root label", msg: "\x01a", wantErr: true},
+		{name: "offset past the end", msg: "\x00", offset: 1, wantErr: true},
+		{name: "name over 255 octets", msg: strings.Repeat("\x3f"+strings.Repeat("a", 63), 4) + "\x00", wantErr: true},
+		{name: "name of 255 octets", msg: strings.Repeat("\x3f"+strings.Repeat("a", 63), 3) + "\x3d" + strings.Repeat("b", 61) + "\x00",
+			want: strings.Repeat(strings.Repeat("a", 63)+".", 3) + strings.Repeat("b", 61), wantEnd: 255},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, end, err := parseDomainName([]byte(tt.msg), tt.offset)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q, want an error", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != tt.want || end != tt.wantEnd {
+				t.Errorf("got %q ending at %d, want %q ending at %d", name, end, tt.want, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestParseQuestions(t *testing.T) {
+	question := "\x01a\x03lan\x00\x00\x01\x00\x01"
+	tests := []struct {
+		name    string
+		msg     string
+		count   int
+		wantErr bool
+	}{
+		{name: "one", msg: question, count: 1},
+		{name: "two", msg: question + question, count: 2},
+		{name: "type and class cut short", msg: question[:len(question)-1], count: 1, wantErr: true},
+		{name: "fewer than announced", msg: question, count: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := append(make([]byte, 12), tt.msg...)
+			questions, end, err := parseQuestions(msg, 12, tt.count)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %d questions, want an error", len(questions))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(questions) != tt.count || end != len(msg) {
+				t.Errorf("got %d questions ending at %d, want %d ending at %d", len(questions), end, tt.count, len(msg))
+			}
+			for _, q := range questions {
+				if q.Name != "a.lan" || q.Type != typeA || q.Class != classIN {
+					t.Errorf("got question %+v, want a.lan A IN", q)
+				}
+			}
+		})
+	}
+}
+
+// TestForwardDNSQueryDiscardsSpoofed checks that a forged response arriving ahead of
+// the resolver's is dropped and the real one still accepted.
+func TestForwardDNSQueryDiscardsSpoofed(t *testing.T) {
+	query := testQuery(t, 0x1234, "www.example.com")
+	forged := func(change func(msg *DNSMessage)) []byte {
+		var msg DNSMessage
+		if err := msg.Unmarshal(reply(query)); err != nil {
+			t.Fatal(err)
+		}
+		change(&msg)
+		response, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	tests := []struct {
+		name    string
+		spoofed []byte
+	}{
+		{name: "other ID", spoofed: forged(func(msg *DNSMessage) { msg.Header.ID = 0x4321 })},
+		{name: "other name", spoofed: forged(func(msg *DNSMessage) { msg.Questions[0].Name = "www.example.net" })},
+		{name: "other type", spoofed: forged(func(msg *DNSMessage) { msg.Questions[0].Type = typeAAAA })},
+		{name: "other class", spoofed: forged(func(msg *DNSMessage) { msg.Questions[0].Class = classCH })},
+		{name: "no question", spoofed: forged(func(msg *DNSMessage) { msg.Questions = nil })},
+		{name: "extra question", spoofed: forged(func(msg *DNSMessage) { msg.Questions = append(msg.Questions, msg.Questions[0]) })},
+		{name: "not a response", spoofed: query},
+		{name: "malformed", spoofed: reply(query)[:len(query)-1]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The name in another case keeps matching, as names are compared case-insensitively
+			genuine := forged(func(msg *DNSMessage) { msg.Questions[0].Name = "WWW.Example.COM" })
+			addr := startUDPUpstream(t, func([]byte) (time.Duration, [][]byte) {
+				return 0, [][]byte{tt.spoofed, genuine}
+			})
+
+			response, _, err := forwardDNSQuery(query, addr, time.Second, time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(response, genuine) {
+				t.Errorf("got %x, want the genuine response %x", response, genuine)
+			}
+		})
+	}
+}
+
+func TestHandleQueryFormErr(t *testing.T) {
+	marshal := func(msg DNSMessage) []byte {
+		wire, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wire
+	}
+	question := []DNSQuestion{{Name: "nas.lan", Type: typeA, Class: classIN}}
+	opt := EDNS{UDPSize: 1232}.record()
+	query := marshal(DNSMessage{Header: DNSHeader{ID: 0x1234, RD: 1}, Questions: question})
+	withCount := func(at int, count byte) []byte { // sets the low byte of a header count
+		msg := append([]byte{}, query...)
+		msg[at] = count
+		return msg
+	}
+
+	tests := []struct {
+		name     string
+		query    []byte
+		wantNone bool // dropped without a response
+		wantOPT  bool
+	}{
+		{name: "no question", query: marshal(DNSMessage{Header: DNSHeader{ID: 0x1234, RD: 1}})},
+		{name: "only an OPT record", query: marshal(DNSMessage{Header: DNSHeader{ID: 0x1234, RD: 1}, Additionals: []ResourceRecord{opt}}), wantOPT: true},
+		{name: "question cut short", query: query[:len(query)-2]},
+		{name: "more questions than sent", query: withCount(5, 2)},
+		{name: "answer count past the end", query: withCount(7, 1)},
+		{name: "two OPT records", query: marshal(DNSMessage{Header: DNSHeader{ID: 0x1234, RD: 1}, Questions: question, Additionals: []ResourceRecord{opt, opt}})},
+		{name: "shorter than a header", query: query[:11], wantNone: true},
+	}
+
+	server := newLocalServer(t, "nas.lan A 10.0.0.10\n")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := handle(server, tt.query)
+			if tt.wantNone {
+				if response != nil {
+					t.Errorf("got response %x, want none", response)
+				}
+				return
+			}
+
+			var msg DNSMessage
+			if err := msg.Unmarshal(response); err != nil {
+				t.Fatalf("response %x doesn't parse: %v", response, err)
+			}
+			if msg.Header.ID != 0x1234 || msg.Header.QR != 1 || msg.Header.RCODE != rcodeFormErr || len(msg.Answers) != 0 {
+				t.Errorf("got ID %x, QR %d, %s and %d answers, want ID 1234, QR 1, FORMERR and none", msg.Header.ID, msg.Header.QR, msg.Header.RCODE, len(msg.Answers))
+			}
+			if _, ok := msg.EDNS(); ok != tt.wantOPT {
+				t.Errorf("got an OPT record: %v, want one: %v", ok, tt.wantOPT)
+			}
+		})
+	}
+}
+
+// benchmarkQuery is a query for www.example.com A with an OPT record, as stub
+// resolvers send them.
+func benchmarkQuery(b *testing.B) []byte {
+	b.Helper()
+
+	msg := DNSMessage{
+		Header:      DNSHeader{ID: 0x1234, RD: 1},
+		Questions:   []DNSQuestion{{Name: "www.example.com", Type: typeA, Class: classIN}},
+		Additionals: []ResourceRecord{EDNS{UDPSize: 1232}.record()},
+	}
+	query, err := msg.Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return query
+}
+
+func BenchmarkParseQuestions(b *testing.B) {
+	query := benchmarkQuery(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseQuestions(query, 12, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBuildResponse(b *testing.B) {
+	query := benchmarkQuery(b)
+	header := parseDNSHeader(query)
+	_, offset, err := parseQuestions(query, 12, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	answers := []ResourceRecord{
+		{Name: "www.example.com", Type: typeCNAME, Class: classIN, TTL: 300, Data: CNAMEData{Target: "web.example.com"}},
+	}
+	for i := 1; i <= 4; i++ {
+		answers = append(answers, ResourceRecord{Name: "web.example.com", Type: typeA, Class: classIN, TTL: 300,
+			Data: AData{IP: net.IPv4(10, 0, 0, byte(i)).To4()}})
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buildResponse(query, offset, header, rcodeNoError, answers, nil)
+	}
+}